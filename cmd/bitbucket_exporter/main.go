@@ -19,6 +19,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/alecthomas/kingpin/v2"
 	"github.com/nandanurseptama/bitbucket-exporter/collector"
@@ -38,12 +39,14 @@ var (
 		Config: &config.Config{},
 	}
 
-	configFile   = kingpin.Flag("config.file", "Bitbucket exporter configuration file.").Default("config.yaml").String()
-	metricsPath  = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").Envar("BITBUCKET_EXPORTER_WEB_TELEMETRY_PATH").String()
-	webConfig    = kingpinflag.AddFlags(kingpin.CommandLine, ":9171")
-	logger       = promslog.NewNopLogger()
-	fromPromFile = kingpin.Flag("metric.from-prom-file", "Whether to expose metric from .prom file").Default("false").Bool()
-	promfile     = kingpin.Flag("metric.prom-file-path", "File path of prom file").Default("example-output.prom").String()
+	configFile       = kingpin.Flag("config.file", "Bitbucket exporter configuration file.").Default("config.yaml").String()
+	metricsPath      = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").Envar("BITBUCKET_EXPORTER_WEB_TELEMETRY_PATH").String()
+	webConfig        = kingpinflag.AddFlags(kingpin.CommandLine, ":9171")
+	logger           = promslog.NewNopLogger()
+	fromPromFile     = kingpin.Flag("metric.from-prom-file", "Whether to expose metric from .prom file").Default("false").Bool()
+	promfile         = kingpin.Flag("metric.prom-file-path", "File path of prom file").Default("example-output.prom").String()
+	snapshotPath     = kingpin.Flag("snapshot.path", "File path to persist collected data across restarts. Empty disables the snapshot.").Default("").Envar("BITBUCKET_EXPORTER_SNAPSHOT_PATH").String()
+	snapshotInterval = kingpin.Flag("snapshot.interval", "Interval between snapshot writes.").Default("5m").Duration()
 )
 
 // Metric name parts.
@@ -79,6 +82,13 @@ func main() {
 	collectors := exporters.GetCollectors()
 	prometheus.MustRegister(collectors...)
 
+	if *snapshotPath != "" {
+		// serve the previous data until the first crawl replaces it
+		if err := exporters.LoadSnapshot(*snapshotPath); err != nil {
+			logger.Warn("Error loading snapshot", "err", err)
+		}
+	}
+
 	if fromPromFile != nil && *fromPromFile {
 		http.Handle(*metricsPath, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			fileBytes, err := os.ReadFile(*promfile)
@@ -91,20 +101,36 @@ func main() {
 			w.WriteHeader(http.StatusOK)
 			w.Write(fileBytes)
 		}))
+		http.HandleFunc("/-/ready", healthyHandler)
 	} else {
 		http.Handle(*metricsPath, promhttp.Handler())
+		http.Handle("/-/ready", readyHandler(exporters))
 	}
+	http.HandleFunc("/-/healthy", healthyHandler)
+	http.Handle("/status", statusHandler(exporters))
 
 	if *metricsPath != "/" && *metricsPath != "" {
 		landingConfig := web.LandingConfig{
-			Name:        "Postgres Exporter",
-			Description: "Prometheus PostgreSQL server Exporter",
+			Name:        "Bitbucket Exporter",
+			Description: "Prometheus Exporter for Bitbucket",
 			Version:     version.Info(),
 			Links: []web.LandingLinks{
 				{
 					Address: *metricsPath,
 					Text:    "Metrics",
 				},
+				{
+					Address: "/status",
+					Text:    "Status",
+				},
+				{
+					Address: "/-/healthy",
+					Text:    "Health",
+				},
+				{
+					Address: "/-/ready",
+					Text:    "Readiness",
+				},
 			},
 		}
 		landingPage, err := web.NewLandingPage(landingConfig)
@@ -136,6 +162,24 @@ func main() {
 		exporters.Exec(ctx)
 	}()
 
+	go func() {
+		if *snapshotPath == "" {
+			return
+		}
+		ticker := time.NewTicker(*snapshotInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := exporters.SaveSnapshot(*snapshotPath); err != nil {
+					logger.Error("Error saving snapshot", "err", err)
+				}
+			}
+		}
+	}()
+
 	<-ctx.Done()
 	logger.Info("Shutting down server...")
 
@@ -143,6 +187,12 @@ func main() {
 		logger.Error("Server forced to shutdown", "err", err)
 	}
 
+	if *snapshotPath != "" {
+		if err := exporters.SaveSnapshot(*snapshotPath); err != nil {
+			logger.Error("Error saving snapshot", "err", err)
+		}
+	}
+
 	logger.Info("Server exited gracefully")
 
 }
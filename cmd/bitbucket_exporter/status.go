@@ -0,0 +1,92 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"time"
+
+	"github.com/nandanurseptama/bitbucket-exporter/collector"
+)
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"timestamp": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format(time.RFC3339)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>Bitbucket Exporter Status</title></head>
+<body>
+<h1>Bitbucket Exporter Status</h1>
+<p>Ready: {{ .Ready }}</p>
+<table border="1" cellpadding="4">
+<tr>
+<th>Collector</th><th>Running</th><th>Last run</th><th>Duration</th><th>Last success</th><th>Error</th><th>Repositories</th><th>Next run</th>
+</tr>
+{{ range .Collectors }}
+<tr>
+<td>{{ .Name }}</td>
+<td>{{ .Running }}</td>
+<td>{{ timestamp .LastRun }}</td>
+<td>{{ .Duration }}</td>
+<td>{{ timestamp .LastSuccess }}</td>
+<td>{{ .Error }}</td>
+<td>{{ if lt .Repositories 0 }}-{{ else }}{{ .Repositories }}{{ end }}</td>
+<td>{{ timestamp .NextRun }}</td>
+</tr>
+{{ end }}
+</table>
+</body>
+</html>
+`))
+
+// healthyHandler reports the process is up.
+func healthyHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Healthy.\n"))
+}
+
+// readyHandler reports whether every collector finished a successful run.
+func readyHandler(exporters *collector.BitbucketCollector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !exporters.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("Not ready.\n"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Ready.\n"))
+	}
+}
+
+// statusHandler renders the runs of every collector.
+func statusHandler(exporters *collector.BitbucketCollector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := struct {
+			Ready      bool
+			Collectors []collector.CollectorStatus
+		}{
+			Ready:      exporters.Ready(),
+			Collectors: exporters.Status(),
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusTemplate.Execute(w, data); err != nil {
+			logger.Error("error rendering status page", "err", err)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+
+	"github.com/nandanurseptama/bitbucket-exporter/config"
+	"github.com/nandanurseptama/bitbucket-exporter/helpers"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// results of a report, always exported so a dashboard sees every state
+var reportResults = []string{"PASSED", "FAILED", "PENDING"}
+
+type reportData struct {
+	ExternalId string `json:"external_id"`
+	Reporter   string `json:"reporter"`
+	ReportType string `json:"report_type"`
+	Result     string `json:"result"`
+	// numeric data fields keyed by title
+	Data map[string]float64 `json:"data"`
+	// total annotation keyed by severity
+	Annotations map[string]uint64 `json:"annotations"`
+}
+
+type codeInsightsData struct {
+	Workspace  string       `json:"workspace"`
+	Project    string       `json:"project"`
+	Repository string       `json:"repository"`
+	Branch     string       `json:"branch"`
+	Reports    []reportData `json:"reports"`
+}
+
+var (
+	codeInsightsLabels = []string{"workspace", "project", "repository", "branch", "report"}
+
+	codeInsightsResultDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemCodeInsights,
+			"report_result",
+		),
+		"Whether the report on the head of main branch has this result",
+		append(codeInsightsLabels, "reporter", "report_type", "result"),
+		nil,
+	)
+	codeInsightsDataDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemCodeInsights,
+			"report_data",
+		),
+		"Numeric data field of the report on the head of main branch, such as coverage or bug count",
+		append(codeInsightsLabels, "field"),
+		nil,
+	)
+	codeInsightsAnnotationsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemCodeInsights,
+			"annotations",
+		),
+		"Total annotation of the report on the head of main branch by severity",
+		append(codeInsightsLabels, "severity"),
+		nil,
+	)
+)
+
+type codeInsightsCollector struct {
+	config *config.CodeInsightsCollectorConfig
+	feed   *repositoryFeed
+	// keyed by repository uuid
+	holders *DataHolder[map[string]codeInsightsData]
+}
+
+func NewCodeInsightsCollector(
+	config *config.CodeInsightsCollectorConfig,
+	feed *repositoryFeed,
+) *codeInsightsCollector {
+	return &codeInsightsCollector{
+		config: config,
+		feed:   feed,
+		holders: &DataHolder[map[string]codeInsightsData]{
+			data: map[string]codeInsightsData{},
+		},
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *codeInsightsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+
+	for _, v := range c.holders.data {
+		for _, report := range v.Reports {
+			labels := []string{v.Workspace, v.Project, v.Repository, v.Branch, report.ExternalId}
+			for _, result := range reportResults {
+				ch <- prometheus.MustNewConstMetric(
+					codeInsightsResultDesc,
+					prometheus.GaugeValue,
+					helpers.BoolToFloat(report.Result == result),
+					append(labels, report.Reporter, report.ReportType, result)...,
+				)
+			}
+			for field, value := range report.Data {
+				ch <- prometheus.MustNewConstMetric(
+					codeInsightsDataDesc,
+					prometheus.GaugeValue,
+					value,
+					append(labels, field)...,
+				)
+			}
+			for severity, total := range report.Annotations {
+				ch <- prometheus.MustNewConstMetric(
+					codeInsightsAnnotationsDesc,
+					prometheus.GaugeValue,
+					float64(total),
+					append(labels, severity)...,
+				)
+			}
+		}
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *codeInsightsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- codeInsightsResultDesc
+	ch <- codeInsightsDataDesc
+	ch <- codeInsightsAnnotationsDesc
+}
+
+func (c *codeInsightsCollector) dataHolders() map[string]holder {
+	return map[string]holder{"repositories": c.holders}
+}
+
+func (c *codeInsightsCollector) repositoryCount() int {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+	return len(c.holders.data)
+}
+
+func (c *codeInsightsCollector) Exec(ctx context.Context, instance *instance) error {
+	return collectRepositories(
+		c.feed,
+		keyCodeInsightsCollector,
+		func(repo Repository) bool {
+			// empty repository has no commit to report on
+			hasMainBranch := repo.MainBranch != nil && repo.MainBranch.Name != ""
+			return hasMainBranch && includesRepository(c.config.IncludedRepository, repo)
+		},
+		c.holders,
+		"code insights",
+		func(repo Repository) (codeInsightsData, error) {
+			return c.getReports(ctx, instance, repo)
+		},
+	)
+}
+
+func (c *codeInsightsCollector) getReports(
+	ctx context.Context,
+	instance *instance,
+	repo Repository,
+) (codeInsightsData, error) {
+	data := codeInsightsData{
+		Workspace:  repo.Workspace.Slug,
+		Project:    repo.Project.Key,
+		Repository: repo.Slug,
+		Branch:     repo.MainBranch.Name,
+	}
+
+	head, err := getMainBranchHead(ctx, instance, repo)
+	if err != nil {
+		return data, err
+	}
+
+	pathParams := map[string]string{
+		":workspace": repo.Workspace.Slug,
+		":repo_slug": repo.Slug,
+		":commit":    head.Hash,
+	}
+
+	var reports []Report
+	err = getAllPages(
+		ctx,
+		instance,
+		commitReportsEndpoint,
+		pathParams,
+		map[string]string{"pagelen": "100"},
+		func(values []Report) error {
+			reports = append(reports, values...)
+			return nil
+		},
+	)
+	if err != nil {
+		return data, err
+	}
+
+	for _, report := range reports {
+		v := reportData{
+			ExternalId:  report.ExternalId,
+			Reporter:    report.Reporter,
+			ReportType:  report.ReportType,
+			Result:      report.Result,
+			Data:        map[string]float64{},
+			Annotations: map[string]uint64{},
+		}
+		for _, field := range report.Data {
+			if value, ok := reportDataValue(field); ok {
+				v.Data[field.Title] = value
+			}
+		}
+
+		reportParams := map[string]string{
+			":workspace": repo.Workspace.Slug,
+			":repo_slug": repo.Slug,
+			":commit":    head.Hash,
+			":report_id": url.PathEscape(report.Uuid),
+		}
+		err := getAllPages(
+			ctx,
+			instance,
+			reportAnnotationsEndpoint,
+			reportParams,
+			map[string]string{"pagelen": "100"},
+			func(values []Annotation) error {
+				for _, annotation := range values {
+					v.Annotations[annotation.Severity]++
+				}
+				return nil
+			},
+		)
+		if err != nil {
+			return data, err
+		}
+
+		data.Reports = append(data.Reports, v)
+	}
+
+	return data, nil
+}
+
+// reportDataValue converts a numeric or boolean data field to a metric value.
+func reportDataValue(field ReportData) (float64, bool) {
+	switch field.Type {
+	case "NUMBER", "PERCENTAGE", "DURATION":
+		var value float64
+		if err := json.Unmarshal(field.Value, &value); err != nil {
+			return 0, false
+		}
+		return value, true
+	case "BOOLEAN":
+		var value bool
+		if err := json.Unmarshal(field.Value, &value); err != nil {
+			return 0, false
+		}
+		return helpers.BoolToFloat(value), true
+	}
+	return 0, false
+}
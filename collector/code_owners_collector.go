@@ -0,0 +1,385 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/nandanurseptama/bitbucket-exporter/config"
+	"github.com/nandanurseptama/bitbucket-exporter/helpers"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type codeOwnersData struct {
+	Workspace        string `json:"workspace"`
+	Project          string `json:"project"`
+	Repository       string `json:"repository"`
+	DefaultReviewers uint64 `json:"default_reviewers"`
+	// whether CODEOWNERS is at the root of the main branch
+	HasCodeOwners bool `json:"has_code_owners"`
+	// files and directories at the root of the main branch
+	TopLevelPaths uint64 `json:"top_level_paths"`
+	// top level paths owned as a whole, the last CODEOWNERS rule matching
+	// them has owners
+	OwnedPaths uint64 `json:"owned_paths"`
+	// users named in CODEOWNERS, without `@`, groups and emails left out
+	Owners []string `json:"owners"`
+}
+
+var (
+	codeOwnersLabels = []string{"workspace", "project", "repository"}
+
+	codeOwnersDefaultReviewersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemCodeOwners,
+			"default_reviewers",
+		),
+		"Total default reviewer of this repo",
+		codeOwnersLabels,
+		nil,
+	)
+	codeOwnersHasFileDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemCodeOwners,
+			"has_file",
+		),
+		"Whether this repo has a CODEOWNERS at the root of its main branch",
+		codeOwnersLabels,
+		nil,
+	)
+	codeOwnersCoverageDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemCodeOwners,
+			"coverage_ratio",
+		),
+		"Ratio of top level files and directories of this repo owned as a whole by a CODEOWNERS rule",
+		codeOwnersLabels,
+		nil,
+	)
+	codeOwnersOrphanedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemCodeOwners,
+			"orphaned_owner",
+		),
+		"Owner named in CODEOWNERS of this repo who is not a member of the workspace",
+		append(codeOwnersLabels, "owner"),
+		nil,
+	)
+	codeOwnersOrphanedTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemCodeOwners,
+			"orphaned_owners",
+		),
+		"Total owner named in CODEOWNERS of this repo who is not a member of the workspace",
+		codeOwnersLabels,
+		nil,
+	)
+)
+
+type codeOwnersCollector struct {
+	config *config.CodeOwnersCollectorConfig
+	feed   *repositoryFeed
+	// owners are checked against the members it collected
+	members *memberCollector
+	// drops the series labelled by owner
+	teams *teamCollector
+	// keyed by repository uuid
+	holders *DataHolder[map[string]codeOwnersData]
+}
+
+func NewCodeOwnersCollector(
+	config *config.CodeOwnersCollectorConfig,
+	feed *repositoryFeed,
+	members *memberCollector,
+	teams *teamCollector,
+) *codeOwnersCollector {
+	return &codeOwnersCollector{
+		config:  config,
+		feed:    feed,
+		members: members,
+		teams:   teams,
+		holders: &DataHolder[map[string]codeOwnersData]{
+			data: map[string]codeOwnersData{},
+		},
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *codeOwnersCollector) Collect(ch chan<- prometheus.Metric) {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+
+	for _, v := range c.holders.data {
+		labels := []string{v.Workspace, v.Project, v.Repository}
+		ch <- prometheus.MustNewConstMetric(
+			codeOwnersDefaultReviewersDesc,
+			prometheus.GaugeValue,
+			float64(v.DefaultReviewers),
+			labels...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			codeOwnersHasFileDesc,
+			prometheus.GaugeValue,
+			helpers.BoolToFloat(v.HasCodeOwners),
+			labels...,
+		)
+
+		var coverage float64
+		if v.TopLevelPaths > 0 {
+			coverage = float64(v.OwnedPaths) / float64(v.TopLevelPaths)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			codeOwnersCoverageDesc,
+			prometheus.GaugeValue,
+			coverage,
+			labels...,
+		)
+
+		var orphaned uint64
+		known := false
+		for _, owner := range v.Owners {
+			member, membersKnown := c.members.hasMember(v.Workspace, owner)
+			known = membersKnown
+			if !membersKnown || member {
+				continue
+			}
+			orphaned++
+			if c.teams.dropUserSeries() {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(
+				codeOwnersOrphanedDesc,
+				prometheus.GaugeValue,
+				1,
+				append(labels, owner)...,
+			)
+		}
+		// unknown until the members of the workspace are collected
+		if known || len(v.Owners) == 0 {
+			ch <- prometheus.MustNewConstMetric(
+				codeOwnersOrphanedTotalDesc,
+				prometheus.GaugeValue,
+				float64(orphaned),
+				labels...,
+			)
+		}
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *codeOwnersCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- codeOwnersDefaultReviewersDesc
+	ch <- codeOwnersHasFileDesc
+	ch <- codeOwnersCoverageDesc
+	ch <- codeOwnersOrphanedDesc
+	ch <- codeOwnersOrphanedTotalDesc
+}
+
+func (c *codeOwnersCollector) dataHolders() map[string]holder {
+	return map[string]holder{"repositories": c.holders}
+}
+
+func (c *codeOwnersCollector) repositoryCount() int {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+	return len(c.holders.data)
+}
+
+func (c *codeOwnersCollector) Exec(ctx context.Context, instance *instance) error {
+	return collectRepositories(
+		c.feed,
+		keyCodeOwnersCollector,
+		func(repo Repository) bool {
+			return includesRepository(c.config.IncludedRepository, repo)
+		},
+		c.holders,
+		"code owners",
+		func(repo Repository) (codeOwnersData, error) {
+			return c.getCodeOwners(ctx, instance, repo)
+		},
+	)
+}
+
+func (c *codeOwnersCollector) getCodeOwners(
+	ctx context.Context,
+	instance *instance,
+	repo Repository,
+) (codeOwnersData, error) {
+	data := codeOwnersData{
+		Workspace:  repo.Workspace.Slug,
+		Project:    repo.Project.Key,
+		Repository: repo.Slug,
+	}
+	pathParams := map[string]string{":workspace": repo.Workspace.Slug, ":repo_slug": repo.Slug}
+
+	err := getAllPages(
+		ctx,
+		instance,
+		defaultReviewersEndpoint,
+		pathParams,
+		map[string]string{"pagelen": "100"},
+		func(values []any) error {
+			data.DefaultReviewers += uint64(len(values))
+			return nil
+		},
+	)
+	if err != nil {
+		return data, err
+	}
+
+	// empty repository has no file to own
+	if repo.MainBranch == nil || repo.MainBranch.Name == "" {
+		return data, nil
+	}
+
+	head, err := getMainBranchHead(ctx, instance, repo)
+	if err != nil {
+		return data, err
+	}
+	srcParams := map[string]string{
+		":workspace": repo.Workspace.Slug,
+		":repo_slug": repo.Slug,
+		":commit":    head.Hash,
+	}
+
+	var entries []TreeEntry
+	err = getAllPages(
+		ctx,
+		instance,
+		srcRepositoryEndpoint,
+		srcParams,
+		map[string]string{"pagelen": "100"},
+		func(values []TreeEntry) error {
+			entries = append(entries, values...)
+			return nil
+		},
+	)
+	if err != nil {
+		return data, err
+	}
+	data.TopLevelPaths = uint64(len(entries))
+
+	file, err := instance.GETRaw(ctx, codeOwnersEndpoint, srcParams, map[string]string{})
+	if errors.Is(err, errNotFound) {
+		return data, nil
+	}
+	if err != nil {
+		return data, err
+	}
+	data.HasCodeOwners = true
+
+	rules, owners := parseCodeOwners(file)
+	data.Owners = owners
+	for _, entry := range entries {
+		if codeOwnersOwned(rules, entry.Path, entry.Type == "commit_directory") {
+			data.OwnedPaths++
+		}
+	}
+
+	return data, nil
+}
+
+// codeOwnersRule is a line of CODEOWNERS.
+type codeOwnersRule struct {
+	pattern string
+	// `!pattern`, or a pattern without owner, removes the ownership of the
+	// paths it matches
+	owned bool
+}
+
+// parseCodeOwners returns the rules in file order and the users they name,
+// without `@`. Groups (`@workspace/group`) and emails are left out of
+// owners.
+func parseCodeOwners(file []byte) (rules []codeOwnersRule, owners []string) {
+	scanner := bufio.NewScanner(bytes.NewReader(file))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		pattern, negated := strings.CutPrefix(fields[0], "!")
+		rules = append(rules, codeOwnersRule{pattern: pattern, owned: !negated && len(fields) > 1})
+		if negated {
+			continue
+		}
+		for _, owner := range fields[1:] {
+			if !strings.HasPrefix(owner, "@") || strings.Contains(owner, "/") {
+				continue
+			}
+			owner = strings.TrimPrefix(owner, "@")
+			if !slices.Contains(owners, owner) {
+				owners = append(owners, owner)
+			}
+		}
+	}
+	return rules, owners
+}
+
+// codeOwnersOwned reports whether the top level name is owned, the last
+// rule matching it wins.
+func codeOwnersOwned(rules []codeOwnersRule, name string, dir bool) bool {
+	owned := false
+	for _, rule := range rules {
+		if codeOwnersMatch(rule.pattern, name, dir) {
+			owned = rule.owned
+		}
+	}
+	return owned
+}
+
+// codeOwnersMatch reports whether pattern matches the top level name as a
+// whole, a directory with everything inside it. Patterns matching only some
+// paths inside a directory, like `src/*.go`, do not match it.
+func codeOwnersMatch(pattern, name string, dir bool) bool {
+	// `**/` matches zero or more directories, zero at the top level
+	for strings.HasPrefix(pattern, "**/") {
+		pattern = strings.TrimPrefix(pattern, "**/")
+	}
+	pattern = strings.TrimPrefix(pattern, "/")
+	if pattern == "**" {
+		return true
+	}
+
+	// `dir/**` owns everything inside dir
+	if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+		if !dir {
+			return false
+		}
+		pattern = prefix
+	}
+	// a trailing `/` only matches directories
+	if prefix, ok := strings.CutSuffix(pattern, "/"); ok {
+		if !dir {
+			return false
+		}
+		pattern = prefix
+	}
+	if strings.Contains(pattern, "/") {
+		return false
+	}
+	matched, err := path.Match(pattern, name)
+	return err == nil && matched
+}
@@ -0,0 +1,119 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseCodeOwners(t *testing.T) {
+	file := []byte(`# comment
+
+*            @alice @workspace/team
+/docs/       @bob alice@example.com
+!docs/api/
+vendor/
+src/**       @carol @alice
+`)
+	rules, owners := parseCodeOwners(file)
+
+	wantRules := []codeOwnersRule{
+		{pattern: "*", owned: true},
+		{pattern: "/docs/", owned: true},
+		{pattern: "docs/api/", owned: false},
+		{pattern: "vendor/", owned: false},
+		{pattern: "src/**", owned: true},
+	}
+	if !slices.Equal(rules, wantRules) {
+		t.Errorf("rules = %v, want %v", rules, wantRules)
+	}
+	wantOwners := []string{"alice", "bob", "carol"}
+	if !slices.Equal(owners, wantOwners) {
+		t.Errorf("owners = %v, want %v", owners, wantOwners)
+	}
+}
+
+func TestCodeOwnersMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		dir     bool
+		want    bool
+	}{
+		{"*", "README.md", false, true},
+		{"*", "src", true, true},
+		{"**", "src", true, true},
+		{"*.md", "README.md", false, true},
+		{"*.md", "main.go", false, false},
+		{"/README.md", "README.md", false, true},
+		{"docs/", "docs", true, true},
+		{"docs/", "docs", false, false},
+		{"/docs/", "docs", true, true},
+		{"docs/**", "docs", true, true},
+		{"docs/**", "docs", false, false},
+		{"docs", "docs", true, true},
+		{"docs", "src", true, false},
+		// only some paths inside the directory
+		{"docs/*.md", "docs", true, false},
+		{"src/main.go", "src", true, false},
+		// `**/` matches zero directories at the top level
+		{"**/docs", "docs", true, true},
+		{"**/docs", "src", true, false},
+		{"**/*.md", "README.md", false, true},
+		{"**/*.md", "src", true, false},
+		{"**/docs/**", "docs", true, true},
+		{"**/build/", "build", false, false},
+		{"[", "x", false, false},
+	}
+	for _, tt := range tests {
+		if got := codeOwnersMatch(tt.pattern, tt.name, tt.dir); got != tt.want {
+			t.Errorf("codeOwnersMatch(%q, %q, %v) = %v, want %v", tt.pattern, tt.name, tt.dir, got, tt.want)
+		}
+	}
+}
+
+func TestCodeOwnersOwned(t *testing.T) {
+	rules, _ := parseCodeOwners([]byte(`
+*           @alice
+!*.lock
+vendor/
+docs/       @bob
+build/
+build/      @carol
+`))
+	tests := []struct {
+		name string
+		dir  bool
+		want bool
+	}{
+		{"README.md", false, true},
+		// negation after a matching rule
+		{"yarn.lock", false, false},
+		// pattern without owner after a matching rule
+		{"vendor", true, false},
+		{"docs", true, true},
+		// the last matching rule wins
+		{"build", true, true},
+	}
+	for _, tt := range tests {
+		if got := codeOwnersOwned(rules, tt.name, tt.dir); got != tt.want {
+			t.Errorf("codeOwnersOwned(%q, %v) = %v, want %v", tt.name, tt.dir, got, tt.want)
+		}
+	}
+
+	if codeOwnersOwned(nil, "README.md", false) {
+		t.Error("codeOwnersOwned without rule = true, want false")
+	}
+}
@@ -24,9 +24,6 @@ import (
 )
 
 var (
-	repositoryRefsDataChannel = make(chan Repository, 1)
-	commitRepoDataChannel     = make(chan Repository, 1)
-
 	scrapeDurationOpts = prometheus.Opts{
 		Namespace:   namespace,
 		Subsystem:   "scrape",
@@ -64,6 +61,16 @@ type BitbucketCollector struct {
 	logger     *slog.Logger
 	instance   *instance
 	collectors map[string]Collector
+	// feed of repositories to the collectors working per repository
+	feed *repositoryFeed
+	// interval between runs, zero runs once
+	interval time.Duration
+	// time of the last successful snapshot write
+	lastSnapshot *DataHolder[time.Time]
+	// run status keyed by collector name
+	status *DataHolder[map[string]*CollectorStatus]
+	// keyed by collector name
+	seriesLimits map[string]*config.SeriesLimitConfig
 }
 
 type Collector interface {
@@ -77,82 +84,269 @@ func NewBitbucketCollector(
 	logger *slog.Logger,
 	config *config.Config,
 ) *BitbucketCollector {
+	feed := newRepositoryFeed(logger)
+	repositories := NewRepositoriesCollector(config.IncludedWorkspace, feed)
+	// owners of code owners and groups of teams are matched to members
+	members := NewMemberCollector(
+		config.IncludedWorkspace,
+		config.Teams.Enabled() || config.CodeOwnersCollector.Enabled(),
+	)
+	collectors := map[string]Collector{
+		keyRepositoriesCollector: repositories,
+		keyMemberCollector:       members,
+	}
+
+	var teams *teamCollector
+	if config.Teams.Enabled() {
+		teams = NewTeamCollector(config.Teams, config.IncludedWorkspace, members)
+		collectors[keyTeamCollector] = teams
+	}
+
+	var refs *refsCollector
+	if config.RefsCollector.Enabled() {
+		feed.register(keyRefsCollector)
+		refs = NewRefsCollector(config.RefsCollector, feed)
+		collectors[keyRefsCollector] = refs
+	}
+
+	var commits *commitCollector
+	if config.CommitCollector.Enabled() {
+		feed.register(keyCommitCollector)
+		commits = NewCommitCollector(config.CommitCollector, feed, teams)
+		collectors[keyCommitCollector] = commits
+	}
+
+	if config.HygieneCollector.Enabled() {
+		feed.register(keyHygieneCollector)
+		collectors[keyHygieneCollector] = NewHygieneCollector(config.HygieneCollector, feed)
+	}
+
+	if config.BranchRestrictionsCollector.Enabled() {
+		feed.register(keyRestrictionCollector)
+		collectors[keyRestrictionCollector] = NewRestrictionCollector(config.BranchRestrictionsCollector, feed)
+	}
+
+	if config.CommitStatusCollector.Enabled() {
+		feed.register(keyCommitStatusCollector)
+		collectors[keyCommitStatusCollector] = NewCommitStatusCollector(config.CommitStatusCollector, feed)
+	}
+
+	if config.CodeInsightsCollector.Enabled() {
+		feed.register(keyCodeInsightsCollector)
+		collectors[keyCodeInsightsCollector] = NewCodeInsightsCollector(config.CodeInsightsCollector, feed)
+	}
+
+	if config.IssueCollector.Enabled() {
+		feed.register(keyIssueCollector)
+		collectors[keyIssueCollector] = NewIssueCollector(config.IssueCollector, feed)
+	}
+
+	if config.ProjectCollector.Enabled() {
+		collectors[keyProjectCollector] = NewProjectCollector(
+			config.ProjectCollector,
+			config.IncludedWorkspace,
+			repositories,
+			refs,
+			commits,
+		)
+	}
+
+	if config.WebhookCollector.Enabled() {
+		feed.register(keyWebhookCollector)
+		collectors[keyWebhookCollector] = NewWebhookCollector(config.WebhookCollector, config.IncludedWorkspace, feed)
+	}
+
+	if config.KeyCollector.Enabled() {
+		feed.register(keyKeyCollector)
+		collectors[keyKeyCollector] = NewKeyCollector(config.KeyCollector, feed, teams)
+	}
+
+	if config.PipelineVariableCollector.Enabled() {
+		feed.register(keyPipelineVarCollector)
+		collectors[keyPipelineVarCollector] = NewPipelineVariableCollector(
+			config.PipelineVariableCollector,
+			config.IncludedWorkspace,
+			feed,
+		)
+	}
+
+	if config.RunnerCollector.Enabled() {
+		feed.register(keyRunnerCollector)
+		collectors[keyRunnerCollector] = NewRunnerCollector(config.RunnerCollector, config.IncludedWorkspace, feed)
+	}
+
+	if config.PipelineCollector.Enabled() {
+		feed.register(keyPipelineCollector)
+		collectors[keyPipelineCollector] = NewPipelineCollector(config.PipelineCollector, feed)
+	}
+
+	if config.PullRequestCollector.Enabled() {
+		feed.register(keyPullRequestCollector)
+		collectors[keyPullRequestCollector] = NewPullRequestCollector(config.PullRequestCollector, feed, teams)
+	}
+
+	if config.CodeOwnersCollector.Enabled() {
+		feed.register(keyCodeOwnersCollector)
+		collectors[keyCodeOwnersCollector] = NewCodeOwnersCollector(config.CodeOwnersCollector, feed, members, teams)
+	}
+
+	if config.LFSCollector.Enabled() {
+		feed.register(keyLFSCollector)
+		collectors[keyLFSCollector] = NewLFSCollector(config.LFSCollector, config.WorkspaceCollector, feed)
+	}
+
+	if config.WorkspaceCollector.Enabled() {
+		feed.register(keyWorkspaceCollector)
+		collectors[keyWorkspaceCollector] = NewWorkspaceCollector(
+			config.WorkspaceCollector,
+			config.IncludedWorkspace,
+			feed,
+			members,
+		)
+	}
+
+	var forks *forkCollector
+	if config.ForkCollector.Enabled() {
+		feed.register(keyForkCollector)
+		forks = NewForkCollector(config.ForkCollector, feed)
+		collectors[keyForkCollector] = forks
+	}
+
+	if config.PopularityCollector.Enabled() {
+		feed.register(keyPopularityCollector)
+		collectors[keyPopularityCollector] = NewPopularityCollector(config.PopularityCollector, feed, commits, forks)
+	}
+
+	status := map[string]*CollectorStatus{}
+	for name := range collectors {
+		status[name] = &CollectorStatus{Name: name, Repositories: -1}
+	}
+
+	for name := range config.SeriesLimits {
+		if _, ok := collectors[name]; !ok {
+			logger.Warn("series limit of a collector not enabled", "collector", name)
+		}
+	}
+
 	return &BitbucketCollector{
-		instance: newInstance(config.Auth),
-		logger:   logger,
-		collectors: map[string]Collector{
-			keyRepositoriesCollector: NewRepositoriesCollector(
-				config.IncludedWorkspace,
-				repositoryRefsDataChannel,
-				commitRepoDataChannel,
-			),
-			keyMemberCollector: NewMemberCollector(config.IncludedWorkspace),
-			keyRefsCollector:   NewRefsCollector(config.RefsCollector, repositoryRefsDataChannel),
-			keyCommitCollector: NewCommitCollector(
-				config.CommitCollector,
-				commitRepoDataChannel,
-			),
+		instance:     newInstance(config.Auth, logger),
+		logger:       logger,
+		collectors:   collectors,
+		feed:         feed,
+		interval:     config.CollectInterval,
+		lastSnapshot: &DataHolder[time.Time]{},
+		status: &DataHolder[map[string]*CollectorStatus]{
+			data: status,
 		},
+		seriesLimits: config.SeriesLimits,
 	}
 }
 
 type mainCollector struct {
+	collectors   map[string]Collector
+	lastSnapshot *DataHolder[time.Time]
 }
 
 func (c *mainCollector) Collect(ch chan<- prometheus.Metric) {
 	scrapeDurationGaugeVec.Collect(ch)
 	scrapeSuccessGaugeVec.Collect(ch)
+	apiRequestsCounterVec.Collect(ch)
+	apiRequestDurationHistogramVec.Collect(ch)
+	apiResponseBytesCounterVec.Collect(ch)
+	apiRetriesCounterVec.Collect(ch)
+	apiRateLimitGaugeVec.Collect(ch)
+	apiRateLimitRemainingGaugeVec.Collect(ch)
+	seriesDroppedCounterVec.Collect(ch)
+	collectDataAge(ch, c.collectors, c.lastSnapshot)
 }
 
 // Describe implements the prometheus.Collector interface.
 func (p *mainCollector) Describe(ch chan<- *prometheus.Desc) {
 	scrapeDurationGaugeVec.Describe(ch)
 	scrapeSuccessGaugeVec.Describe(ch)
+	apiRequestsCounterVec.Describe(ch)
+	apiRequestDurationHistogramVec.Describe(ch)
+	apiResponseBytesCounterVec.Describe(ch)
+	apiRetriesCounterVec.Describe(ch)
+	apiRateLimitGaugeVec.Describe(ch)
+	apiRateLimitRemainingGaugeVec.Describe(ch)
+	seriesDroppedCounterVec.Describe(ch)
+	ch <- dataAgeDesc
+	ch <- snapshotLastSaveDesc
 }
 
 // Get all collectors
 func (c *BitbucketCollector) GetCollectors() []prometheus.Collector {
 	var collectors []prometheus.Collector
-	collectors = append(collectors, &mainCollector{})
-	for _, v := range c.collectors {
+	collectors = append(collectors, &mainCollector{
+		collectors:   c.collectors,
+		lastSnapshot: c.lastSnapshot,
+	})
+	for name, v := range c.collectors {
+		if limit := c.seriesLimits[name]; limit.Enabled() {
+			collectors = append(collectors, &limitedCollector{Collector: v, name: name, config: limit})
+			continue
+		}
 		collectors = append(collectors, v)
 	}
 	return collectors
 }
 
 // collect bitbucket data at background
+//
+// collectors run again every interval until ctx is canceled.
 func (c *BitbucketCollector) Exec(ctx context.Context) {
+	for {
+		c.run(ctx)
+
+		if c.interval <= 0 {
+			// wait until context canceled
+			<-ctx.Done()
+			return
+		}
+
+		c.setNextRun(time.Now().Add(c.interval))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.interval):
+		}
+	}
+}
+
+// run executes every collector once.
+func (c *BitbucketCollector) run(ctx context.Context) {
 	var wg sync.WaitGroup
 
+	c.feed.open()
 	for name, collector := range c.collectors {
 		wg.Add(1)
 		go func(name string, collector Collector) {
 			defer wg.Done()
-			execute(ctx, name, collector, c.instance, c.logger)
+			c.execute(ctx, name, collector)
 		}(name, collector)
 	}
 
 	// wait until all collectors finish
 	wg.Wait()
-
-	// wait until context canceled
-	<-ctx.Done()
 }
 
-func execute(
-	ctx context.Context, name string, c Collector, instance *instance, logger *slog.Logger,
+func (c *BitbucketCollector) execute(
+	ctx context.Context, name string, collector Collector,
 ) {
 	begin := time.Now()
-	err := c.Exec(ctx, instance)
+	c.startRun(name, begin)
+	err := collector.Exec(ctx, c.instance)
 	duration := time.Since(begin)
 	var success float64
 	if err != nil {
-		logger.Error("collector failed", "name", name, "duration_seconds", duration.Seconds(), "err", err)
+		c.logger.Error("collector failed", "name", name, "duration_seconds", duration.Seconds(), "err", err)
 		success = 0
 	} else {
-		logger.Debug("collector succeeded", "name", name, "duration_seconds", duration.Seconds())
+		c.logger.Debug("collector succeeded", "name", name, "duration_seconds", duration.Seconds())
 		success = 1
 	}
-	scrapeDurationGaugeVec.WithLabelValues(name).Add(duration.Seconds())
+	c.finishRun(name, collector, duration, err)
+	scrapeDurationGaugeVec.WithLabelValues(name).Set(duration.Seconds())
 	scrapeSuccessGaugeVec.WithLabelValues(name).Set(success)
 }
@@ -15,64 +15,83 @@ package collector
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/url"
 	"slices"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/nandanurseptama/bitbucket-exporter/config"
-	"github.com/nandanurseptama/bitbucket-exporter/helpers"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type repoCommitData struct {
-	workspace string
-	project   string
-	repo      string
-	total     uint64
+	Workspace string `json:"workspace"`
+	Project   string `json:"project"`
+	Repo      string `json:"repo"`
+	Total     uint64 `json:"total"`
 }
 
 type userCommitData struct {
-	workspace string
-	project   string
-	repo      string
-	nickname  string
+	Workspace string `json:"workspace"`
+	Project   string `json:"project"`
+	Repo      string `json:"repo"`
 	// nickname user
-	total uint64
+	Nickname string `json:"nickname"`
+	Uuid     string `json:"uuid"`
+	// email of the first commit counted
+	Email string `json:"email"`
+	Total uint64 `json:"total"`
 }
 
+// committers are counted over the commits of the last days
+const recentCommitterDays = 90
+
 func (r *repoCommitData) Inc() {
-	r.total = r.total + 1
+	r.Total = r.Total + 1
 }
 
 type commitCollector struct {
-	config                *config.CommitCollectorConfig
-	commitRepoDataChannel <-chan Repository
-	repoTotalCommit       DataHolder[map[string]*repoCommitData]
-	userTotalCommit       DataHolder[map[string]*userCommitData]
+	config *config.CommitCollectorConfig
+	feed   *repositoryFeed
+	// users are aggregated per team, nil when no team is defined
+	teams *teamCollector
+	// keyed by repository uuid
+	repoTotalCommit DataHolder[map[string]*repoCommitData]
+	// keyed by repository uuid, then user uuid or raw author when not
+	// linked to a Bitbucket user
+	userTotalCommit DataHolder[map[string]map[string]*userCommitData]
+	// distinct authors of the last recentCommitterDays, keyed by repository uuid
+	recentCommitters DataHolder[map[string]uint64]
 }
 
 func NewCommitCollector(
 	config *config.CommitCollectorConfig,
-	commitRepoDataChannel <-chan Repository,
-
+	feed *repositoryFeed,
+	teams *teamCollector,
 ) *commitCollector {
 	return &commitCollector{
-		config:                config,
-		commitRepoDataChannel: commitRepoDataChannel,
-		userTotalCommit: DataHolder[map[string]*userCommitData]{
-			data: map[string]*userCommitData{},
+		config: config,
+		feed:   feed,
+		teams:  teams,
+		userTotalCommit: DataHolder[map[string]map[string]*userCommitData]{
+			data: map[string]map[string]*userCommitData{},
 		},
 		repoTotalCommit: DataHolder[map[string]*repoCommitData]{
 			data: map[string]*repoCommitData{},
 		},
+		recentCommitters: DataHolder[map[string]uint64]{
+			data: map[string]uint64{},
+		},
 	}
 }
 
 var (
 	repoCommitLabels = []string{"workspace", "project", "repository"}
 	userCommitLabels = []string{"workspace", "project", "repository", "user"}
+	teamCommitLabels = []string{"workspace", "project", "repository", "team"}
 
 	repoTotalCommitDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(
@@ -95,6 +114,17 @@ var (
 		userCommitLabels,
 		nil,
 	)
+
+	teamTotalCommitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemCommit,
+			"team_total",
+		),
+		"Total commit of the members of this team",
+		teamCommitLabels,
+		nil,
+	)
 )
 
 // Collect implements the prometheus.Collector interface.
@@ -106,14 +136,43 @@ func (c *commitCollector) Collect(ch chan<- prometheus.Metric) {
 		c.userTotalCommit.Lock()
 		defer c.userTotalCommit.Unlock()
 		defer wg.Done()
-		for _, v := range c.userTotalCommit.data {
-			labels := []string{v.workspace, v.project, v.repo, v.nickname}
-			ch <- prometheus.MustNewConstMetric(
-				userTotalCommitDesc,
-				prometheus.GaugeValue,
-				float64(v.total),
-				labels...,
-			)
+		for _, users := range c.userTotalCommit.data {
+			// authors not linked to a Bitbucket user share the empty nickname
+			userTotal := map[string]uint64{}
+			teamTotal := map[string]uint64{}
+			var repo *userCommitData
+			for _, v := range users {
+				repo = v
+				userTotal[v.Nickname] += v.Total
+				user := User{Uuid: v.Uuid, Nickname: v.Nickname}
+				for _, team := range c.teams.teamsOf(v.Workspace, user, v.Email) {
+					teamTotal[team] += v.Total
+				}
+			}
+			if repo == nil {
+				continue
+			}
+
+			if !c.teams.dropUserSeries() {
+				for nickname, total := range userTotal {
+					labels := []string{repo.Workspace, repo.Project, repo.Repo, nickname}
+					ch <- prometheus.MustNewConstMetric(
+						userTotalCommitDesc,
+						prometheus.GaugeValue,
+						float64(total),
+						labels...,
+					)
+				}
+			}
+			for team, total := range teamTotal {
+				labels := []string{repo.Workspace, repo.Project, repo.Repo, team}
+				ch <- prometheus.MustNewConstMetric(
+					teamTotalCommitDesc,
+					prometheus.GaugeValue,
+					float64(total),
+					labels...,
+				)
+			}
 		}
 	}()
 
@@ -123,11 +182,11 @@ func (c *commitCollector) Collect(ch chan<- prometheus.Metric) {
 		defer c.repoTotalCommit.Unlock()
 		defer wg.Done()
 		for _, v := range c.repoTotalCommit.data {
-			labels := []string{v.workspace, v.project, v.repo}
+			labels := []string{v.Workspace, v.Project, v.Repo}
 			ch <- prometheus.MustNewConstMetric(
 				repoTotalCommitDesc,
 				prometheus.GaugeValue,
-				float64(v.total),
+				float64(v.Total),
 				labels...,
 			)
 		}
@@ -140,15 +199,43 @@ func (c *commitCollector) Collect(ch chan<- prometheus.Metric) {
 func (p *commitCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- repoTotalCommitDesc
 	ch <- userTotalCommitDesc
+	ch <- teamTotalCommitDesc
+}
+
+func (c *commitCollector) dataHolders() map[string]holder {
+	return map[string]holder{
+		"repo_total_commit": &c.repoTotalCommit,
+		"user_total_commit": &c.userTotalCommit,
+		"recent_committers": &c.recentCommitters,
+	}
 }
 
 func (c *commitCollector) Exec(ctx context.Context, instance *instance) error {
-	if len(c.config.IncludedRepository) < 1 {
-		return nil
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	seen := map[string]bool{}
+
+	count := func(repo Repository) {
+		seen[repo.Uuid] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := c.getTotalCommit(ctx, instance, repo)
+			if skippable(err) {
+				c.feed.logger.Info("skipping repository", "collector", keyCommitCollector, "repository", repo.FullName, "err", err)
+				return
+			}
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("error counting commits of %s: %w", repo.FullName, err))
+				mu.Unlock()
+			}
+		}()
 	}
 
-	for repo := range c.commitRepoDataChannel {
-		if c.config == nil {
+	for repo := range c.feed.subscribe(keyCommitCollector) {
+		if c.config == nil || len(c.config.IncludedRepository) < 1 {
 			continue
 		}
 
@@ -157,7 +244,7 @@ func (c *commitCollector) Exec(ctx context.Context, instance *instance) error {
 		}
 		first := c.config.IncludedRepository[0]
 		if first == "*" && len(c.config.IncludedRepository) == 1 {
-			go c.getTotalCommit(ctx, instance, repo)
+			count(repo)
 			continue
 		}
 
@@ -170,10 +257,26 @@ func (c *commitCollector) Exec(ctx context.Context, instance *instance) error {
 			continue
 		}
 
-		go c.getTotalCommit(ctx, instance, repo)
+		count(repo)
+	}
 
+	// wait until commits of every repository counted
+	wg.Wait()
+
+	if c.feed.completed() {
+		pruneRepositories(&c.repoTotalCommit, seen)
+		pruneRepositories(&c.userTotalCommit, seen)
+		pruneRepositories(&c.recentCommitters, seen)
 	}
-	return nil
+	return errors.Join(errs...)
+}
+
+func (c *commitCollector) repositoryCount() int {
+	c.repoTotalCommit.Lock()
+	defer c.repoTotalCommit.Unlock()
+	c.userTotalCommit.Lock()
+	defer c.userTotalCommit.Unlock()
+	return max(len(c.repoTotalCommit.data), len(c.userTotalCommit.data))
 }
 
 func (c *commitCollector) getTotalCommit(
@@ -181,37 +284,63 @@ func (c *commitCollector) getTotalCommit(
 	instance *instance,
 	repo Repository,
 ) error {
+	// count into local data, so a partial crawl never replaces
+	// what is already served
+	repoCommit := &repoCommitData{
+		Workspace: repo.Workspace.Slug,
+		Project:   repo.Project.Key,
+		Repo:      repo.Slug,
+	}
+	userCommits := map[string]*userCommitData{}
+	recentSince := time.Now().AddDate(0, 0, -recentCommitterDays)
+	recentCommitters := map[string]bool{}
+
 	page := 1
 	for {
-		endpoint := helpers.StrReplace(
+		pathParams := map[string]string{":workspace": repo.Workspace.Slug, ":repo_slug": repo.Slug}
+		var responseBody PaginationResponse[Commit]
+		err := instance.GET(
+			ctx,
 			listCommitRepositoryEndpoint,
-			map[string]string{":workspace_repo_slug": fmt.Sprintf("%s/%s", repo.Workspace.Slug, repo.Slug)},
+			pathParams,
+			map[string]string{"page": strconv.Itoa(page)},
+			&responseBody,
 		)
-		var responseBody PaginationResponse[Commit]
-		err := instance.GET(ctx, endpoint, map[string]string{"page": strconv.Itoa(page)}, &responseBody)
 
 		if err != nil {
 			return err
 		}
 
 		values := responseBody.Values
-		if len(values) > 0 {
-			// write total commit repo
-			if c.config.CollectTotalCommitRepo {
-				c.appendTotalCommitRepo(repo, responseBody.PageLen)
+		repoCommit.Total = repoCommit.Total + uint64(len(values))
+		for _, commit := range values {
+			// author not linked to a Bitbucket user only has the raw one
+			author := commit.Author.User.Uuid
+			if author == "" {
+				author = commit.Author.Raw
 			}
 
-			if c.config.CollectTotalCommitUser {
-				c.appendTotalCommitUser(repo, values)
+			userCommit := userCommits[author]
+			if userCommit == nil {
+				userCommit = &userCommitData{
+					Workspace: repo.Workspace.Slug,
+					Project:   repo.Project.Key,
+					Repo:      repo.Slug,
+					Nickname:  commit.Author.User.Nickname,
+					Uuid:      commit.Author.User.Uuid,
+					Email:     authorEmail(commit.Author.Raw),
+				}
+				userCommits[author] = userCommit
 			}
-		}
+			userCommit.Total = userCommit.Total + 1
 
-		if responseBody.Next == nil {
-			return nil
+			if commit.Date.After(recentSince) {
+				recentCommitters[author] = true
+			}
 		}
 
-		if *responseBody.Next == "" {
-			return nil
+		if responseBody.Next == nil || *responseBody.Next == "" {
+			break
 		}
 
 		nextPageUrl, err := url.Parse(*responseBody.Next)
@@ -222,7 +351,7 @@ func (c *commitCollector) getTotalCommit(
 
 		nextPageStr := nextPageUrl.Query().Get("page")
 		if nextPageStr == "" {
-			return nil
+			break
 		}
 
 		nextPage, err := strconv.Atoi(nextPageStr)
@@ -233,40 +362,30 @@ func (c *commitCollector) getTotalCommit(
 		page = nextPage
 
 	}
+
+	if c.config.CollectTotalCommitRepo {
+		c.setTotalCommitRepo(repo, repoCommit)
+	}
+
+	if c.config.CollectTotalCommitUser {
+		c.setTotalCommitUser(repo, userCommits)
+	}
+
+	c.recentCommitters.Lock()
+	c.recentCommitters.data[repo.Uuid] = uint64(len(recentCommitters))
+	c.recentCommitters.touch()
+	c.recentCommitters.Unlock()
+	return nil
 }
-func (c *commitCollector) appendTotalCommitRepo(repo Repository, totalCommit uint64) {
+func (c *commitCollector) setTotalCommitRepo(repo Repository, repoCommit *repoCommitData) {
 	c.repoTotalCommit.Lock()
-	var repoCommit = c.repoTotalCommit.data[repo.Uuid]
-	if repoCommit == nil {
-		repoCommit = &repoCommitData{
-			workspace: repo.Workspace.Slug,
-			project:   repo.Project.Key,
-			repo:      repo.Slug,
-			total:     totalCommit,
-		}
-	} else {
-		repoCommit.total = repoCommit.total + totalCommit
-	}
 	c.repoTotalCommit.data[repo.Uuid] = repoCommit
+	c.repoTotalCommit.touch()
 	c.repoTotalCommit.Unlock()
 }
-func (c *commitCollector) appendTotalCommitUser(repo Repository, commits []Commit) {
-	for _, commit := range commits {
-		c.userTotalCommit.Lock()
-		var userCommit = c.userTotalCommit.data[commit.Author.User.Uuid]
-		if userCommit == nil {
-			userCommit = &userCommitData{
-				workspace: repo.Workspace.Slug,
-				project:   repo.Project.Key,
-				repo:      repo.Slug,
-				nickname:  commit.Author.User.Nickname,
-				total:     1,
-			}
-		} else {
-			userCommit.total = userCommit.total + 1
-		}
-
-		c.userTotalCommit.data[commit.Author.User.Uuid] = userCommit
-		c.userTotalCommit.Unlock()
-	}
+func (c *commitCollector) setTotalCommitUser(repo Repository, userCommits map[string]*userCommitData) {
+	c.userTotalCommit.Lock()
+	c.userTotalCommit.data[repo.Uuid] = userCommits
+	c.userTotalCommit.touch()
+	c.userTotalCommit.Unlock()
 }
@@ -0,0 +1,186 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+
+	"github.com/nandanurseptama/bitbucket-exporter/config"
+	"github.com/nandanurseptama/bitbucket-exporter/helpers"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// states of a commit status, always exported so a missing state reads as 0
+var commitStatusStates = []string{"SUCCESSFUL", "FAILED", "INPROGRESS", "STOPPED"}
+
+type commitStatusData struct {
+	Workspace  string `json:"workspace"`
+	Project    string `json:"project"`
+	Repository string `json:"repository"`
+	Branch     string `json:"branch"`
+	Commit     string `json:"commit"`
+	// total status keyed by status key, then state
+	Statuses map[string]map[string]uint64 `json:"statuses"`
+}
+
+var (
+	commitStatusLabels = []string{"workspace", "project", "repository", "branch"}
+
+	commitStatusTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemCommitStatus,
+			"total",
+		),
+		"Total build status on the head of main branch by key and state",
+		append(commitStatusLabels, "key", "state"),
+		nil,
+	)
+	commitStatusFailedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemCommitStatus,
+			"main_branch_failed",
+		),
+		"Whether a build status on the head of main branch is FAILED",
+		commitStatusLabels,
+		nil,
+	)
+)
+
+type commitStatusCollector struct {
+	config *config.CommitStatusCollectorConfig
+	feed   *repositoryFeed
+	// keyed by repository uuid
+	holders *DataHolder[map[string]commitStatusData]
+}
+
+func NewCommitStatusCollector(
+	config *config.CommitStatusCollectorConfig,
+	feed *repositoryFeed,
+) *commitStatusCollector {
+	return &commitStatusCollector{
+		config: config,
+		feed:   feed,
+		holders: &DataHolder[map[string]commitStatusData]{
+			data: map[string]commitStatusData{},
+		},
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *commitStatusCollector) Collect(ch chan<- prometheus.Metric) {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+
+	for _, v := range c.holders.data {
+		labels := []string{v.Workspace, v.Project, v.Repository, v.Branch}
+
+		failed := false
+		for key, states := range v.Statuses {
+			for _, state := range commitStatusStates {
+				ch <- prometheus.MustNewConstMetric(
+					commitStatusTotalDesc,
+					prometheus.GaugeValue,
+					float64(states[state]),
+					append(labels, key, state)...,
+				)
+			}
+			failed = failed || states["FAILED"] > 0
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			commitStatusFailedDesc,
+			prometheus.GaugeValue,
+			helpers.BoolToFloat(failed),
+			labels...,
+		)
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *commitStatusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- commitStatusTotalDesc
+	ch <- commitStatusFailedDesc
+}
+
+func (c *commitStatusCollector) dataHolders() map[string]holder {
+	return map[string]holder{"repositories": c.holders}
+}
+
+func (c *commitStatusCollector) repositoryCount() int {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+	return len(c.holders.data)
+}
+
+func (c *commitStatusCollector) Exec(ctx context.Context, instance *instance) error {
+	return collectRepositories(
+		c.feed,
+		keyCommitStatusCollector,
+		func(repo Repository) bool {
+			// empty repository has no commit to report on
+			hasMainBranch := repo.MainBranch != nil && repo.MainBranch.Name != ""
+			return hasMainBranch && includesRepository(c.config.IncludedRepository, repo)
+		},
+		c.holders,
+		"commit statuses",
+		func(repo Repository) (commitStatusData, error) {
+			return c.getStatuses(ctx, instance, repo)
+		},
+	)
+}
+
+func (c *commitStatusCollector) getStatuses(
+	ctx context.Context,
+	instance *instance,
+	repo Repository,
+) (commitStatusData, error) {
+	data := commitStatusData{
+		Workspace:  repo.Workspace.Slug,
+		Project:    repo.Project.Key,
+		Repository: repo.Slug,
+		Branch:     repo.MainBranch.Name,
+		Statuses:   map[string]map[string]uint64{},
+	}
+
+	head, err := getMainBranchHead(ctx, instance, repo)
+	if err != nil {
+		return data, err
+	}
+	data.Commit = head.Hash
+
+	pathParams := map[string]string{
+		":workspace": repo.Workspace.Slug,
+		":repo_slug": repo.Slug,
+		":commit":    head.Hash,
+	}
+	err = getAllPages(
+		ctx,
+		instance,
+		commitStatusesEndpoint,
+		pathParams,
+		map[string]string{"pagelen": "100"},
+		func(values []CommitStatus) error {
+			for _, v := range values {
+				if data.Statuses[v.Key] == nil {
+					data.Statuses[v.Key] = map[string]uint64{}
+				}
+				data.Statuses[v.Key][v.State]++
+			}
+			return nil
+		},
+	)
+	return data, err
+}
@@ -23,6 +23,26 @@ const (
 	subSystemMember       = "member"
 	subSystemRepoRefs     = "repository_refs"
 	subSystemCommit       = "commit"
+	subSystemExporter     = "exporter"
+	subSystemHygiene      = "repository_hygiene"
+	subSystemRestriction  = "branch_restriction"
+	subSystemCommitStatus = "commit_status"
+	subSystemCodeInsights = "code_insights"
+	subSystemIssue        = "issue"
+	subSystemProject      = "project"
+	subSystemWebhook      = "webhook"
+	subSystemKey          = "key"
+	subSystemPipelineVar  = "pipeline_variable"
+	subSystemRunner       = "runner"
+	subSystemPipelineStep = "pipeline_step"
+	subSystemPipelineTest = "pipeline_test"
+	subSystemPullRequest  = "pull_request"
+	subSystemCodeOwners   = "code_owners"
+	subSystemLFS          = "lfs"
+	subSystemWorkspace    = "workspace"
+	subSystemFork         = "fork"
+	subSystemPopularity   = "popularity"
+	subSystemTeam         = "team"
 )
 
 // key for mapping collectors
@@ -32,12 +52,65 @@ const (
 	keyMemberCollector       = "member"
 	keyRefsCollector         = "refs"
 	keyCommitCollector       = "commit"
+	keyHygieneCollector      = "hygiene"
+	keyRestrictionCollector  = "branch_restrictions"
+	keyCommitStatusCollector = "commit_status"
+	keyCodeInsightsCollector = "code_insights"
+	keyIssueCollector        = "issue"
+	keyProjectCollector      = "project"
+	keyWebhookCollector      = "webhook"
+	keyKeyCollector          = "key"
+	keyPipelineVarCollector  = "pipeline_variable"
+	keyRunnerCollector       = "runner"
+	keyPipelineCollector     = "pipeline"
+	keyPullRequestCollector  = "pull_request"
+	keyCodeOwnersCollector   = "code_owners"
+	keyLFSCollector          = "lfs"
+	keyWorkspaceCollector    = "workspace"
+	keyForkCollector         = "fork"
+	keyPopularityCollector   = "popularity"
+	keyTeamCollector         = "teams"
 )
 
 // endpoint
 const (
-	repositoriesEndpoint         = "repositories"
+	repositoriesEndpoint         = "repositories/:workspace"
 	workspaceMembersEndpoint     = "workspaces/:workspace/members"
 	refsRepositoryEndpoint       = "repositories/:workspace/:repo_slug/refs"
-	listCommitRepositoryEndpoint = "repositories/:workspace_repo_slug/commits"
+	listCommitRepositoryEndpoint = "repositories/:workspace/:repo_slug/commits"
+	branchRepositoryEndpoint     = "repositories/:workspace/:repo_slug/refs/branches/:branch"
+	srcRepositoryEndpoint        = "repositories/:workspace/:repo_slug/src/:commit/"
+	branchRestrictionsEndpoint   = "repositories/:workspace/:repo_slug/branch-restrictions"
+	branchingModelEndpoint       = "repositories/:workspace/:repo_slug/branching-model"
+	defaultReviewersEndpoint     = "repositories/:workspace/:repo_slug/default-reviewers"
+	commitStatusesEndpoint       = "repositories/:workspace/:repo_slug/commit/:commit/statuses"
+	commitReportsEndpoint        = "repositories/:workspace/:repo_slug/commit/:commit/reports"
+	reportAnnotationsEndpoint    = "repositories/:workspace/:repo_slug/commit/:commit/reports/:report_id/annotations"
+	issuesEndpoint               = "repositories/:workspace/:repo_slug/issues"
+	workspaceProjectsEndpoint    = "workspaces/:workspace/projects"
+	repositoryHooksEndpoint      = "repositories/:workspace/:repo_slug/hooks"
+	workspaceHooksEndpoint       = "workspaces/:workspace/hooks"
+	deployKeysEndpoint           = "repositories/:workspace/:repo_slug/deploy-keys"
+	currentUserEndpoint          = "user"
+	userSSHKeysEndpoint          = "users/:user/ssh-keys"
+	repositoryVariablesEndpoint  = "repositories/:workspace/:repo_slug/pipelines_config/variables"
+	environmentsEndpoint         = "repositories/:workspace/:repo_slug/environments"
+	environmentVariablesEndpoint = "repositories/:workspace/:repo_slug/deployments_config/environments/:environment/variables"
+	workspaceVariablesEndpoint   = "workspaces/:workspace/pipelines-config/variables"
+	pipelinesEndpoint            = "repositories/:workspace/:repo_slug/pipelines"
+	pipelineStepsEndpoint        = "repositories/:workspace/:repo_slug/pipelines/:pipeline/steps"
+	stepTestReportsEndpoint      = "repositories/:workspace/:repo_slug/pipelines/:pipeline/steps/:step/test_reports"
+	stepTestCasesEndpoint        = "repositories/:workspace/:repo_slug/pipelines/:pipeline/steps/:step/test_reports/test_cases"
+	pullRequestsEndpoint         = "repositories/:workspace/:repo_slug/pullrequests"
+	pullRequestActivityEndpoint  = "repositories/:workspace/:repo_slug/pullrequests/:pull_request/activity"
+	pullRequestDiffstatEndpoint  = "repositories/:workspace/:repo_slug/pullrequests/:pull_request/diffstat"
+	codeOwnersEndpoint           = "repositories/:workspace/:repo_slug/src/:commit/CODEOWNERS"
+	bitbucketCodeOwnersEndpoint  = "repositories/:workspace/:repo_slug/src/:commit/.bitbucket/CODEOWNERS"
+	forksEndpoint                = "repositories/:workspace/:repo_slug/forks"
+	watchersEndpoint             = "repositories/:workspace/:repo_slug/watchers"
+	// 1.0 API
+	groupMembersEndpoint = "groups/:workspace/:group_slug/members"
+	// internal API
+	repositoryRunnersEndpoint = "repositories/:workspace/:repo_slug/pipelines-config/runners"
+	workspaceRunnersEndpoint  = "workspaces/:workspace/pipelines-config/runners"
 )
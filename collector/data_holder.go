@@ -13,9 +13,81 @@
 
 package collector
 
-import "sync"
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
 
 type DataHolder[T any] struct {
 	sync.Mutex
 	data T
+	// last time data was written
+	updatedAt time.Time
+}
+
+// holder is a DataHolder that can be persisted to a snapshot.
+type holder interface {
+	json.Marshaler
+	json.Unmarshaler
+	lastUpdate() time.Time
+}
+
+// dataHolderSnapshot is the on-disk form of a DataHolder.
+type dataHolderSnapshot[T any] struct {
+	UpdatedAt time.Time `json:"updated_at"`
+	Data      T         `json:"data"`
+}
+
+// touch records that data has been written.
+//
+// must be called while holding the lock.
+func (h *DataHolder[T]) touch() {
+	h.updatedAt = time.Now()
+}
+
+func (h *DataHolder[T]) lastUpdate() time.Time {
+	h.Lock()
+	defer h.Unlock()
+	return h.updatedAt
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (h *DataHolder[T]) MarshalJSON() ([]byte, error) {
+	h.Lock()
+	defer h.Unlock()
+	return json.Marshal(dataHolderSnapshot[T]{
+		UpdatedAt: h.updatedAt,
+		Data:      h.data,
+	})
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+//
+// data is left as is when b fails to decode, or holds no data.
+func (h *DataHolder[T]) UnmarshalJSON(b []byte) error {
+	var snapshot dataHolderSnapshot[*T]
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		return err
+	}
+	h.Lock()
+	defer h.Unlock()
+	if snapshot.Data != nil {
+		h.data = *snapshot.Data
+	}
+	h.updatedAt = snapshot.UpdatedAt
+	return nil
+}
+
+// holderValues returns the values of holders, each keeping a map.
+func holderValues[T any](holders ...*DataHolder[map[string]T]) []T {
+	var values []T
+	for _, h := range holders {
+		h.Lock()
+		for _, v := range h.data {
+			values = append(values, v)
+		}
+		h.Unlock()
+	}
+	return values
 }
@@ -0,0 +1,212 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+
+	"github.com/nandanurseptama/bitbucket-exporter/config"
+	"github.com/nandanurseptama/bitbucket-exporter/helpers"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type forkData struct {
+	Workspace  string `json:"workspace"`
+	Project    string `json:"project"`
+	Repository string `json:"repository"`
+	// full name of the repository this one is forked from, empty when not a fork
+	Parent string `json:"parent"`
+	Forks  uint64 `json:"forks"`
+	// open pull requests into this repository
+	OpenPullRequests uint64 `json:"open_pull_requests"`
+	// open pull requests into this repository whose source is a fork
+	ForkPullRequests uint64 `json:"fork_pull_requests"`
+}
+
+var (
+	forkLabels = []string{"workspace", "project", "repository"}
+
+	forkTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemFork,
+			"total",
+		),
+		"Total fork of this repo",
+		forkLabels,
+		nil,
+	)
+	forkIsForkDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemFork,
+			"is_fork",
+		),
+		"Whether this repo is a fork, parent is the full name of the repo it is forked from",
+		append(forkLabels, "parent"),
+		nil,
+	)
+	forkOpenPullRequestsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemFork,
+			"open_pull_requests",
+		),
+		"Total open pull request into this repo",
+		forkLabels,
+		nil,
+	)
+	forkOpenForkPullRequestsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemFork,
+			"open_pull_requests_from_fork",
+		),
+		"Total open pull request into this repo whose source is a fork",
+		forkLabels,
+		nil,
+	)
+)
+
+type forkCollector struct {
+	config *config.ForkCollectorConfig
+	feed   *repositoryFeed
+	// keyed by repository uuid
+	holders *DataHolder[map[string]forkData]
+}
+
+func NewForkCollector(config *config.ForkCollectorConfig, feed *repositoryFeed) *forkCollector {
+	return &forkCollector{
+		config: config,
+		feed:   feed,
+		holders: &DataHolder[map[string]forkData]{
+			data: map[string]forkData{},
+		},
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *forkCollector) Collect(ch chan<- prometheus.Metric) {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+
+	for _, v := range c.holders.data {
+		labels := []string{v.Workspace, v.Project, v.Repository}
+		ch <- prometheus.MustNewConstMetric(
+			forkTotalDesc,
+			prometheus.GaugeValue,
+			float64(v.Forks),
+			labels...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			forkIsForkDesc,
+			prometheus.GaugeValue,
+			helpers.BoolToFloat(v.Parent != ""),
+			append(labels, v.Parent)...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			forkOpenPullRequestsDesc,
+			prometheus.GaugeValue,
+			float64(v.OpenPullRequests),
+			labels...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			forkOpenForkPullRequestsDesc,
+			prometheus.GaugeValue,
+			float64(v.ForkPullRequests),
+			labels...,
+		)
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *forkCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- forkTotalDesc
+	ch <- forkIsForkDesc
+	ch <- forkOpenPullRequestsDesc
+	ch <- forkOpenForkPullRequestsDesc
+}
+
+func (c *forkCollector) dataHolders() map[string]holder {
+	return map[string]holder{"repositories": c.holders}
+}
+
+func (c *forkCollector) repositoryCount() int {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+	return len(c.holders.data)
+}
+
+func (c *forkCollector) Exec(ctx context.Context, instance *instance) error {
+	return collectRepositories(
+		c.feed,
+		keyForkCollector,
+		func(repo Repository) bool {
+			return includesRepository(c.config.IncludedRepository, repo)
+		},
+		c.holders,
+		"forks",
+		func(repo Repository) (forkData, error) {
+			return getForks(ctx, instance, repo)
+		},
+	)
+}
+
+// getForks returns the forks of repo and the open pull requests coming
+// from them.
+func getForks(ctx context.Context, instance *instance, repo Repository) (forkData, error) {
+	data := forkData{
+		Workspace:  repo.Workspace.Slug,
+		Project:    repo.Project.Key,
+		Repository: repo.Slug,
+	}
+	if repo.Parent != nil {
+		data.Parent = repo.Parent.FullName
+	}
+	pathParams := map[string]string{":workspace": repo.Workspace.Slug, ":repo_slug": repo.Slug}
+
+	err := getAllPages(
+		ctx,
+		instance,
+		forksEndpoint,
+		pathParams,
+		map[string]string{"pagelen": "100"},
+		func(values []Repository) error {
+			data.Forks += uint64(len(values))
+			return nil
+		},
+	)
+	if err != nil {
+		return data, err
+	}
+
+	err = getAllPages(
+		ctx,
+		instance,
+		pullRequestsEndpoint,
+		pathParams,
+		map[string]string{"pagelen": "50", "state": "OPEN"},
+		func(values []PullRequest) error {
+			for _, v := range values {
+				data.OpenPullRequests++
+				// source of a deleted fork is not returned
+				if v.Source.Repository == nil || v.Source.Repository.Uuid != repo.Uuid {
+					data.ForkPullRequests++
+				}
+			}
+			return nil
+		},
+	)
+	return data, err
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"slices"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// histogramData is a histogram kept between runs, Buckets aligned with the
+// upper bounds it is observed with.
+type histogramData struct {
+	Count   uint64   `json:"count"`
+	Sum     float64  `json:"sum"`
+	Buckets []uint64 `json:"buckets"`
+}
+
+func newHistogramData(upperBounds []float64) histogramData {
+	return histogramData{Buckets: make([]uint64, len(upperBounds))}
+}
+
+func (h *histogramData) observe(upperBounds []float64, value float64) {
+	h.Count++
+	h.Sum += value
+	for i, upperBound := range upperBounds {
+		if value <= upperBound && i < len(h.Buckets) {
+			h.Buckets[i]++
+		}
+	}
+}
+
+// clone returns a copy observed without changing h, which may be collected
+// meanwhile.
+func (h histogramData) clone() histogramData {
+	h.Buckets = slices.Clone(h.Buckets)
+	return h
+}
+
+// merge adds the observations of other, observed with the same upper bounds.
+func (h *histogramData) merge(other histogramData) {
+	h.Count += other.Count
+	h.Sum += other.Sum
+	for i := range h.Buckets {
+		if i < len(other.Buckets) {
+			h.Buckets[i] += other.Buckets[i]
+		}
+	}
+}
+
+func (h histogramData) metric(desc *prometheus.Desc, upperBounds []float64, labels ...string) prometheus.Metric {
+	buckets := map[float64]uint64{}
+	for i, upperBound := range upperBounds {
+		if i < len(h.Buckets) {
+			buckets[upperBound] = h.Buckets[i]
+		}
+	}
+	return prometheus.MustNewConstHistogram(desc, h.Count, h.Sum, buckets, labels...)
+}
@@ -0,0 +1,361 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/nandanurseptama/bitbucket-exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// default of stale_days
+const defaultStaleDays = 180
+
+type hygieneData struct {
+	Workspace  string `json:"workspace"`
+	Project    string `json:"project"`
+	Repository string `json:"repository"`
+	// empty when repository has no commit
+	MainBranch    string `json:"main_branch"`
+	HasReadme     bool   `json:"has_readme"`
+	HasLicense    bool   `json:"has_license"`
+	HasCodeowners bool   `json:"has_codeowners"`
+	// nil when branch restrictions cannot be read, the admin permission is required
+	MainBranchProtected *bool `json:"main_branch_protected"`
+	IsFork              bool  `json:"is_fork"`
+	EmptyDescription    bool  `json:"empty_description"`
+	// last commit on main branch, or last update of an empty repository
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// hygieneSignal is a yes/no check exported per repository and summed per workspace.
+type hygieneSignal struct {
+	name  string
+	desc  *prometheus.Desc
+	value func(v hygieneData, staleBefore time.Time) bool
+	// nil when the signal is always known
+	known func(v hygieneData) bool
+}
+
+var (
+	hygieneLabels = []string{"workspace", "project", "repository"}
+
+	hygieneInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemHygiene,
+			"info",
+		),
+		"Main branch of this repo",
+		append(hygieneLabels, "main_branch"),
+		nil,
+	)
+	hygieneLastActivityDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemHygiene,
+			"last_activity_timestamp_seconds",
+		),
+		"Timestamp of the last commit on main branch, or last update of an empty repo",
+		hygieneLabels,
+		nil,
+	)
+	hygieneWorkspaceRepositoriesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemHygiene,
+			"workspace_repositories",
+		),
+		"Total repo checked inside the workspace",
+		[]string{"workspace"},
+		nil,
+	)
+	hygieneWorkspaceSignalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemHygiene,
+			"workspace_signal_repositories",
+		),
+		"Total repo inside the workspace for which the signal is 1",
+		[]string{"workspace", "signal"},
+		nil,
+	)
+
+	hygieneSignals = []hygieneSignal{
+		newHygieneSignal("has_readme", "Whether this repo has a README at its root", func(v hygieneData, _ time.Time) bool {
+			return v.HasReadme
+		}),
+		newHygieneSignal("has_license", "Whether this repo has a LICENSE at its root", func(v hygieneData, _ time.Time) bool {
+			return v.HasLicense
+		}),
+		newHygieneSignal("has_codeowners", "Whether this repo has a CODEOWNERS at its root or in .bitbucket", func(v hygieneData, _ time.Time) bool {
+			return v.HasCodeowners
+		}),
+		newHygieneSignal("main_branch_protected", "Whether push, force push or delete is restricted on the main branch of this repo, missing when branch restrictions are forbidden", func(v hygieneData, _ time.Time) bool {
+			return v.MainBranchProtected != nil && *v.MainBranchProtected
+		}).knownWhen(func(v hygieneData) bool {
+			return v.MainBranchProtected != nil
+		}),
+		newHygieneSignal("is_fork", "Whether this repo is a fork", func(v hygieneData, _ time.Time) bool {
+			return v.IsFork
+		}),
+		newHygieneSignal("empty_description", "Whether this repo has no description", func(v hygieneData, _ time.Time) bool {
+			return v.EmptyDescription
+		}),
+		newHygieneSignal("stale", "Whether this repo has no activity for stale_days", func(v hygieneData, staleBefore time.Time) bool {
+			return v.LastActivity.Before(staleBefore)
+		}),
+	}
+)
+
+func newHygieneSignal(name, help string, value func(v hygieneData, staleBefore time.Time) bool) hygieneSignal {
+	return hygieneSignal{
+		name: name,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(
+				namespace,
+				subSystemHygiene,
+				name,
+			),
+			help,
+			hygieneLabels,
+			nil,
+		),
+		value: value,
+	}
+}
+
+// knownWhen omits the signal of the repositories for which known is false.
+func (s hygieneSignal) knownWhen(known func(v hygieneData) bool) hygieneSignal {
+	s.known = known
+	return s
+}
+
+type hygieneCollector struct {
+	config *config.HygieneCollectorConfig
+	feed   *repositoryFeed
+	// keyed by repository uuid
+	holders *DataHolder[map[string]hygieneData]
+}
+
+func NewHygieneCollector(config *config.HygieneCollectorConfig, feed *repositoryFeed) *hygieneCollector {
+	return &hygieneCollector{
+		config: config,
+		feed:   feed,
+		holders: &DataHolder[map[string]hygieneData]{
+			data: map[string]hygieneData{},
+		},
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *hygieneCollector) Collect(ch chan<- prometheus.Metric) {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+
+	staleDays := c.config.StaleDays
+	if staleDays <= 0 {
+		staleDays = defaultStaleDays
+	}
+	staleBefore := time.Now().AddDate(0, 0, -staleDays)
+
+	workspaceTotal := map[string]int{}
+	workspaceSignal := map[string]map[string]int{}
+	for _, v := range c.holders.data {
+		labels := []string{v.Workspace, v.Project, v.Repository}
+		ch <- prometheus.MustNewConstMetric(
+			hygieneInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			append(labels, v.MainBranch)...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			hygieneLastActivityDesc,
+			prometheus.GaugeValue,
+			float64(v.LastActivity.Unix()),
+			labels...,
+		)
+
+		workspaceTotal[v.Workspace]++
+		if workspaceSignal[v.Workspace] == nil {
+			workspaceSignal[v.Workspace] = map[string]int{}
+		}
+		for _, signal := range hygieneSignals {
+			if signal.known != nil && !signal.known(v) {
+				continue
+			}
+			var value float64
+			if signal.value(v, staleBefore) {
+				value = 1
+				workspaceSignal[v.Workspace][signal.name]++
+			}
+			ch <- prometheus.MustNewConstMetric(
+				signal.desc,
+				prometheus.GaugeValue,
+				value,
+				labels...,
+			)
+		}
+	}
+
+	for workspace, total := range workspaceTotal {
+		ch <- prometheus.MustNewConstMetric(
+			hygieneWorkspaceRepositoriesDesc,
+			prometheus.GaugeValue,
+			float64(total),
+			workspace,
+		)
+		for _, signal := range hygieneSignals {
+			ch <- prometheus.MustNewConstMetric(
+				hygieneWorkspaceSignalDesc,
+				prometheus.GaugeValue,
+				float64(workspaceSignal[workspace][signal.name]),
+				workspace,
+				signal.name,
+			)
+		}
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *hygieneCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- hygieneInfoDesc
+	ch <- hygieneLastActivityDesc
+	ch <- hygieneWorkspaceRepositoriesDesc
+	ch <- hygieneWorkspaceSignalDesc
+	for _, signal := range hygieneSignals {
+		ch <- signal.desc
+	}
+}
+
+func (c *hygieneCollector) dataHolders() map[string]holder {
+	return map[string]holder{"repositories": c.holders}
+}
+
+func (c *hygieneCollector) repositoryCount() int {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+	return len(c.holders.data)
+}
+
+func (c *hygieneCollector) Exec(ctx context.Context, instance *instance) error {
+	return collectRepositories(
+		c.feed,
+		keyHygieneCollector,
+		func(repo Repository) bool {
+			return includesRepository(c.config.IncludedRepository, repo)
+		},
+		c.holders,
+		"repository hygiene",
+		func(repo Repository) (hygieneData, error) {
+			return c.getHygiene(ctx, instance, repo)
+		},
+	)
+}
+
+func (c *hygieneCollector) getHygiene(
+	ctx context.Context,
+	instance *instance,
+	repo Repository,
+) (hygieneData, error) {
+	data := hygieneData{
+		Workspace:        repo.Workspace.Slug,
+		Project:          repo.Project.Key,
+		Repository:       repo.Slug,
+		IsFork:           repo.Parent != nil,
+		EmptyDescription: strings.TrimSpace(repo.Description) == "",
+		LastActivity:     repo.UpdatedOn,
+	}
+
+	// empty repository, nothing to look at
+	if repo.MainBranch == nil || repo.MainBranch.Name == "" {
+		data.MainBranchProtected = new(bool)
+		return data, nil
+	}
+	data.MainBranch = repo.MainBranch.Name
+
+	head, err := getMainBranchHead(ctx, instance, repo)
+	if err != nil {
+		return data, err
+	}
+	if !head.Date.IsZero() {
+		data.LastActivity = head.Date
+	}
+
+	pathParams := map[string]string{
+		":workspace": repo.Workspace.Slug,
+		":repo_slug": repo.Slug,
+		":commit":    head.Hash,
+	}
+	hasBitbucketDir := false
+	err = getAllPages(
+		ctx,
+		instance,
+		srcRepositoryEndpoint,
+		pathParams,
+		map[string]string{"pagelen": "100"},
+		func(values []TreeEntry) error {
+			for _, v := range values {
+				if v.Type == "commit_directory" && v.Path == ".bitbucket" {
+					hasBitbucketDir = true
+				}
+				if v.Type != "commit_file" {
+					continue
+				}
+				name := strings.ToUpper(strings.TrimSuffix(v.Path, path.Ext(v.Path)))
+				switch name {
+				case "README":
+					data.HasReadme = true
+				case "LICENSE", "LICENCE", "COPYING":
+					data.HasLicense = true
+				case "CODEOWNERS":
+					data.HasCodeowners = true
+				}
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return data, err
+	}
+
+	// bitbucket also reads CODEOWNERS from the .bitbucket directory
+	if !data.HasCodeowners && hasBitbucketDir {
+		_, err = instance.GETRaw(ctx, bitbucketCodeOwnersEndpoint, pathParams, map[string]string{})
+		switch {
+		case errors.Is(err, errNotFound):
+		case err != nil:
+			return data, err
+		default:
+			data.HasCodeowners = true
+		}
+	}
+
+	// same check as bitbucket_branch_restriction_main_branch_protected,
+	// left unknown rather than losing the other signals without admin
+	protected, err := getMainBranchProtected(ctx, instance, repo)
+	if skippable(err) {
+		return data, nil
+	}
+	if err != nil {
+		return data, err
+	}
+	data.MainBranchProtected = &protected
+	return data, nil
+}
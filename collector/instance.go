@@ -17,25 +17,103 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/nandanurseptama/bitbucket-exporter/config"
+	"github.com/nandanurseptama/bitbucket-exporter/helpers"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// how many times a failed request is retried
+const maxRetries = 3
+
+var (
+	apiLabels = []string{"endpoint", "method"}
+
+	apiRequestsCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subSystemExporter,
+			Name:      "api_requests_total",
+			Help:      "Total of requests sent to the Bitbucket API.",
+		},
+		[]string{"endpoint", "method", "code"},
+	)
+	apiRequestDurationHistogramVec = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subSystemExporter,
+			Name:      "api_request_duration_seconds",
+			Help:      "Latency of requests sent to the Bitbucket API.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		apiLabels,
+	)
+	apiResponseBytesCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subSystemExporter,
+			Name:      "api_response_bytes_total",
+			Help:      "Total of bytes received from the Bitbucket API.",
+		},
+		apiLabels,
+	)
+	apiRetriesCounterVec = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subSystemExporter,
+			Name:      "api_retries_total",
+			Help:      "Total of retried requests to the Bitbucket API.",
+		},
+		apiLabels,
+	)
+	apiRateLimitGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subSystemExporter,
+			Name:      "api_rate_limit",
+			Help:      "Request budget of the Bitbucket API rate limit, from the last response headers.",
+		},
+		[]string{"resource"},
+	)
+	apiRateLimitRemainingGaugeVec = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subSystemExporter,
+			Name:      "api_rate_limit_remaining",
+			Help:      "Remaining request budget of the Bitbucket API rate limit, from the last response headers.",
+		},
+		[]string{"resource"},
+	)
 )
 
 type instance struct {
 	*http.Client
 	*config.AuthConfig
 	baseUrl string
+	// 1.0 API, for the resources missing from 2.0 such as groups
+	legacyBaseUrl string
+	// internal API of the Bitbucket UI, for the resources missing from both
+	// such as runners. It is not documented and may change without notice.
+	internalBaseUrl string
+	logger          *slog.Logger
 }
 
-func newInstance(authConfig *config.AuthConfig) *instance {
+func newInstance(authConfig *config.AuthConfig, logger *slog.Logger) *instance {
 	return &instance{
-		Client:     http.DefaultClient,
-		AuthConfig: authConfig,
-		baseUrl:    "https://api.bitbucket.org/2.0",
+		Client:          http.DefaultClient,
+		AuthConfig:      authConfig,
+		baseUrl:         "https://api.bitbucket.org/2.0",
+		legacyBaseUrl:   "https://api.bitbucket.org/1.0",
+		internalBaseUrl: "https://api.bitbucket.org/internal",
+		logger:          logger,
 	}
 }
 func (i *instance) GetDefaultHeaders() http.Header {
@@ -54,17 +132,95 @@ func (i *instance) GetDefaultHeaders() http.Header {
 	return header
 }
 
+// GET fetch endpoint and decode the json response into respBodyDest.
+//
+// endpoint is a template such as `repositories/:workspace`, filled with
+// pathParams. The template is used as label of the api metrics, so it
+// must not be formatted by the caller.
 func (i *instance) GET(
 	ctx context.Context,
 	endpoint string,
+	pathParams map[string]string,
+	params map[string]string,
+	respBodyDest any,
+) error {
+	bodyRes, err := i.GETRaw(ctx, endpoint, pathParams, params)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(bodyRes, respBodyDest)
+
+	if err != nil {
+		return fmt.Errorf("unmarshal response body err : %v", err)
+	}
+
+	return nil
+}
+
+// GETLegacy fetch endpoint of the 1.0 API like GET.
+func (i *instance) GETLegacy(
+	ctx context.Context,
+	endpoint string,
+	pathParams map[string]string,
 	params map[string]string,
 	respBodyDest any,
 ) error {
-	uri := strings.Join([]string{i.baseUrl, endpoint}, "/")
+	bodyRes, err := i.get(ctx, i.legacyBaseUrl, endpoint, pathParams, params)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(bodyRes, respBodyDest); err != nil {
+		return fmt.Errorf("unmarshal response body err : %v", err)
+	}
+
+	return nil
+}
+
+// GETInternal fetch endpoint of the internal API like GET.
+func (i *instance) GETInternal(
+	ctx context.Context,
+	endpoint string,
+	pathParams map[string]string,
+	params map[string]string,
+	respBodyDest any,
+) error {
+	bodyRes, err := i.get(ctx, i.internalBaseUrl, endpoint, pathParams, params)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(bodyRes, respBodyDest); err != nil {
+		return fmt.Errorf("unmarshal response body err : %v", err)
+	}
+
+	return nil
+}
+
+// GETRaw fetch endpoint like GET and returns the response body as is, for
+// endpoints serving files.
+func (i *instance) GETRaw(
+	ctx context.Context,
+	endpoint string,
+	pathParams map[string]string,
+	params map[string]string,
+) ([]byte, error) {
+	return i.get(ctx, i.baseUrl, endpoint, pathParams, params)
+}
+
+func (i *instance) get(
+	ctx context.Context,
+	baseUrl string,
+	endpoint string,
+	pathParams map[string]string,
+	params map[string]string,
+) ([]byte, error) {
+	uri := strings.Join([]string{baseUrl, helpers.StrReplace(endpoint, pathParams)}, "/")
 	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
 
 	if err != nil {
-		return fmt.Errorf("instance err : %v", err)
+		return nil, fmt.Errorf("instance err : %v", err)
 	}
 	req.Header = i.GetDefaultHeaders()
 
@@ -75,26 +231,156 @@ func (i *instance) GET(
 	}
 
 	req.URL.RawQuery = q.Encode()
-	fmt.Println(req.URL.String())
 
-	res, err := i.Do(req)
+	return i.do(req, endpoint)
+}
 
-	if err != nil {
-		return fmt.Errorf("instance err : %v", err)
-	}
+// do send req, retrying on network errors, rate limiting and server errors.
+func (i *instance) do(req *http.Request, endpoint string) ([]byte, error) {
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			apiRetriesCounterVec.WithLabelValues(endpoint, req.Method).Inc()
+			select {
+			case <-req.Context().Done():
+				return nil, fmt.Errorf("instance err : %v", req.Context().Err())
+			case <-time.After(backoff):
+			}
+			backoff = backoff * 2
+		}
 
-	defer res.Body.Close()
+		begin := time.Now()
+		res, err := i.Do(req)
+		if err != nil {
+			apiRequestsCounterVec.WithLabelValues(endpoint, req.Method, "error").Inc()
+			i.logger.Debug("api request failed", "url", req.URL.String(), "attempt", attempt, "err", err)
+			if attempt < maxRetries && req.Context().Err() == nil {
+				continue
+			}
+			return nil, fmt.Errorf("instance err : %v", err)
+		}
 
-	bodyRes, err := io.ReadAll(res.Body)
-	if err != nil {
-		return fmt.Errorf("instance err : %v", err)
-	}
+		bodyRes, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		duration := time.Since(begin)
 
-	err = json.Unmarshal(bodyRes, respBodyDest)
+		apiRequestsCounterVec.WithLabelValues(endpoint, req.Method, strconv.Itoa(res.StatusCode)).Inc()
+		apiRequestDurationHistogramVec.WithLabelValues(endpoint, req.Method).Observe(duration.Seconds())
+		apiResponseBytesCounterVec.WithLabelValues(endpoint, req.Method).Add(float64(len(bodyRes)))
+		observeRateLimit(res.Header)
 
-	if err != nil {
-		return fmt.Errorf("unmarshal response body err : %v", err)
+		i.logger.Debug(
+			"api request",
+			"url", req.URL.String(),
+			"status", res.StatusCode,
+			"duration_seconds", duration.Seconds(),
+			"attempt", attempt,
+		)
+
+		if err != nil {
+			return nil, fmt.Errorf("instance err : %v", err)
+		}
+
+		if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= http.StatusInternalServerError {
+			if attempt < maxRetries {
+				if retryAfter, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+					backoff = time.Duration(retryAfter) * time.Second
+				}
+				continue
+			}
+		}
+
+		if res.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("instance err : %w from %s", errNotFound, endpoint)
+		}
+		if res.StatusCode == http.StatusForbidden {
+			return nil, fmt.Errorf("instance err : %w from %s", errForbidden, endpoint)
+		}
+
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return nil, fmt.Errorf("instance err : unexpected status %d from %s", res.StatusCode, endpoint)
+		}
+
+		return bodyRes, nil
 	}
+}
 
-	return nil
+// observeRateLimit records the rate limit budget reported by the response headers.
+func observeRateLimit(header http.Header) {
+	resource := header.Get("X-RateLimit-Resource")
+	if v, err := strconv.ParseFloat(header.Get("X-RateLimit-Limit"), 64); err == nil {
+		apiRateLimitGaugeVec.WithLabelValues(resource).Set(v)
+	}
+	if v, err := strconv.ParseFloat(header.Get("X-RateLimit-Remaining"), 64); err == nil {
+		apiRateLimitRemainingGaugeVec.WithLabelValues(resource).Set(v)
+	}
+}
+
+// errNotFound is returned when the API answers 404.
+var errNotFound = errors.New("not found")
+
+// errForbidden is returned when the API answers 403, the credentials lack
+// the permission the endpoint needs.
+var errForbidden = errors.New("forbidden")
+
+// errLastPage is returned by the fn of getAllPages to stop paging without
+// an error.
+var errLastPage = errors.New("last page")
+
+// getAllPages fetch every page of a paginated endpoint, calling fn with the
+// values of each page.
+func getAllPages[T any](
+	ctx context.Context,
+	instance *instance,
+	endpoint string,
+	pathParams map[string]string,
+	params map[string]string,
+	fn func(values []T) error,
+) error {
+	return getPages(ctx, instance.GET, endpoint, pathParams, params, fn)
+}
+
+// getAllInternalPages fetch every page of a paginated endpoint of the
+// internal API like getAllPages.
+func getAllInternalPages[T any](
+	ctx context.Context,
+	instance *instance,
+	endpoint string,
+	pathParams map[string]string,
+	params map[string]string,
+	fn func(values []T) error,
+) error {
+	return getPages(ctx, instance.GETInternal, endpoint, pathParams, params, fn)
+}
+
+func getPages[T any](
+	ctx context.Context,
+	get func(ctx context.Context, endpoint string, pathParams map[string]string, params map[string]string, respBodyDest any) error,
+	endpoint string,
+	pathParams map[string]string,
+	params map[string]string,
+	fn func(values []T) error,
+) error {
+	for {
+		var respBody PaginationResponse[T]
+		if err := get(ctx, endpoint, pathParams, params, &respBody); err != nil {
+			return err
+		}
+
+		if err := fn(respBody.Values); err != nil {
+			if errors.Is(err, errLastPage) {
+				return nil
+			}
+			return err
+		}
+
+		next, err := respBody.NextParams()
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			return nil
+		}
+		params = next
+	}
 }
@@ -0,0 +1,218 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"github.com/nandanurseptama/bitbucket-exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// states of an issue still waiting for work
+	openIssueStates = []string{"new", "open", "submitted", "on hold"}
+	// states of a resolved issue
+	resolvedIssueStates = []string{"resolved", "closed"}
+
+	// upper bounds of the time to the last update of a resolved issue, in
+	// seconds: 1h, 1d, 1w, 30d, 90d, 365d
+	issueClosedLastUpdateBuckets = []float64{3600, 86400, 604800, 2592000, 7776000, 31536000}
+)
+
+type issueTotalData struct {
+	State    string `json:"state"`
+	Kind     string `json:"kind"`
+	Priority string `json:"priority"`
+	Total    uint64 `json:"total"`
+}
+
+type issueData struct {
+	Workspace  string           `json:"workspace"`
+	Project    string           `json:"project"`
+	Repository string           `json:"repository"`
+	Totals     []issueTotalData `json:"totals"`
+	// creation of the oldest open issue, zero when nothing open
+	OldestOpen time.Time `json:"oldest_open"`
+	// time from creation to the last update of resolved issues, observed
+	// with issueClosedLastUpdateBuckets
+	ClosedLastUpdate histogramData `json:"closed_last_update"`
+}
+
+var (
+	issueLabels = []string{"workspace", "project", "repository"}
+
+	issueTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemIssue,
+			"total",
+		),
+		"Total issue of this repo by state, kind and priority",
+		append(issueLabels, "state", "kind", "priority"),
+		nil,
+	)
+	issueOldestOpenAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemIssue,
+			"oldest_open_age_seconds",
+		),
+		"Age of the oldest open issue of this repo",
+		issueLabels,
+		nil,
+	)
+	issueClosedLastUpdateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemIssue,
+			"closed_last_update_seconds",
+		),
+		"Time from creation to the last update of resolved or closed issues of this repo, not their resolution time as an update after the resolution counts",
+		issueLabels,
+		nil,
+	)
+)
+
+type issueCollector struct {
+	config *config.IssueCollectorConfig
+	feed   *repositoryFeed
+	// keyed by repository uuid
+	holders *DataHolder[map[string]issueData]
+}
+
+func NewIssueCollector(config *config.IssueCollectorConfig, feed *repositoryFeed) *issueCollector {
+	return &issueCollector{
+		config: config,
+		feed:   feed,
+		holders: &DataHolder[map[string]issueData]{
+			data: map[string]issueData{},
+		},
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *issueCollector) Collect(ch chan<- prometheus.Metric) {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+
+	now := time.Now()
+	for _, v := range c.holders.data {
+		labels := []string{v.Workspace, v.Project, v.Repository}
+		for _, total := range v.Totals {
+			ch <- prometheus.MustNewConstMetric(
+				issueTotalDesc,
+				prometheus.GaugeValue,
+				float64(total.Total),
+				append(labels, total.State, total.Kind, total.Priority)...,
+			)
+		}
+
+		var oldestOpenAge float64
+		if !v.OldestOpen.IsZero() {
+			oldestOpenAge = now.Sub(v.OldestOpen).Seconds()
+		}
+		ch <- prometheus.MustNewConstMetric(
+			issueOldestOpenAgeDesc,
+			prometheus.GaugeValue,
+			oldestOpenAge,
+			labels...,
+		)
+
+		ch <- v.ClosedLastUpdate.metric(issueClosedLastUpdateDesc, issueClosedLastUpdateBuckets, labels...)
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *issueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- issueTotalDesc
+	ch <- issueOldestOpenAgeDesc
+	ch <- issueClosedLastUpdateDesc
+}
+
+func (c *issueCollector) dataHolders() map[string]holder {
+	return map[string]holder{"repositories": c.holders}
+}
+
+func (c *issueCollector) repositoryCount() int {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+	return len(c.holders.data)
+}
+
+func (c *issueCollector) Exec(ctx context.Context, instance *instance) error {
+	return collectRepositories(
+		c.feed,
+		keyIssueCollector,
+		func(repo Repository) bool {
+			return repo.HasIssues && includesRepository(c.config.IncludedRepository, repo)
+		},
+		c.holders,
+		"issues",
+		func(repo Repository) (issueData, error) {
+			return c.getIssues(ctx, instance, repo)
+		},
+	)
+}
+
+func (c *issueCollector) getIssues(
+	ctx context.Context,
+	instance *instance,
+	repo Repository,
+) (issueData, error) {
+	data := issueData{
+		Workspace:        repo.Workspace.Slug,
+		Project:          repo.Project.Key,
+		Repository:       repo.Slug,
+		ClosedLastUpdate: newHistogramData(issueClosedLastUpdateBuckets),
+	}
+	totals := map[issueTotalData]uint64{}
+
+	pathParams := map[string]string{":workspace": repo.Workspace.Slug, ":repo_slug": repo.Slug}
+	err := getAllPages(
+		ctx,
+		instance,
+		issuesEndpoint,
+		pathParams,
+		map[string]string{"pagelen": "50"},
+		func(values []Issue) error {
+			for _, v := range values {
+				totals[issueTotalData{State: v.State, Kind: v.Kind, Priority: v.Priority}]++
+
+				if slices.Contains(openIssueStates, v.State) {
+					if data.OldestOpen.IsZero() || v.CreatedOn.Before(data.OldestOpen) {
+						data.OldestOpen = v.CreatedOn
+					}
+				}
+
+				// the API has no resolution date, only the last update
+				if slices.Contains(resolvedIssueStates, v.State) {
+					data.ClosedLastUpdate.observe(issueClosedLastUpdateBuckets, v.UpdatedOn.Sub(v.CreatedOn).Seconds())
+				}
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return data, err
+	}
+
+	for key, total := range totals {
+		key.Total = total
+		data.Totals = append(data.Totals, key)
+	}
+	return data, nil
+}
@@ -0,0 +1,349 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nandanurseptama/bitbucket-exporter/config"
+	"github.com/nandanurseptama/bitbucket-exporter/helpers"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type keyData struct {
+	Id    string `json:"id"`
+	Label string `json:"label"`
+	// ssh-rsa, ssh-ed25519, ecdsa-sha2-nistp256, ...
+	Type      string    `json:"type"`
+	Bits      int       `json:"bits"`
+	CreatedOn time.Time `json:"created_on"`
+	// zero when never used
+	LastUsed time.Time `json:"last_used"`
+}
+
+type keyOwnerData struct {
+	Workspace string `json:"workspace"`
+	// set for deploy keys
+	Project    string `json:"project,omitempty"`
+	Repository string `json:"repository,omitempty"`
+	// set for ssh keys
+	User     string    `json:"user,omitempty"`
+	UserUuid string    `json:"user_uuid,omitempty"`
+	Keys     []keyData `json:"keys"`
+}
+
+// keyDescs are the metrics of one kind of key.
+type keyDescs struct {
+	total    *prometheus.Desc
+	age      *prometheus.Desc
+	lastUsed *prometheus.Desc
+	overdue  *prometheus.Desc
+}
+
+var (
+	deployKeyDescs = newKeyDescs("deploy", "deploy key of this repo", []string{"workspace", "project", "repository"})
+	sshKeyDescs    = newKeyDescs("ssh", "ssh key of the authenticated user", []string{"user"})
+)
+
+func newKeyDescs(kind, what string, labels []string) keyDescs {
+	keyLabels := append(append([]string{}, labels...), "key", "label", "type", "bits")
+	newDesc := func(name, help string, labels []string) *prometheus.Desc {
+		return prometheus.NewDesc(
+			prometheus.BuildFQName(
+				namespace,
+				subSystemKey,
+				kind+"_"+name,
+			),
+			help,
+			labels,
+			nil,
+		)
+	}
+	return keyDescs{
+		total:    newDesc("total", "Total "+what, labels),
+		age:      newDesc("age_seconds", "Age of this "+what, keyLabels),
+		lastUsed: newDesc("last_used_timestamp_seconds", "Timestamp of the last use of this "+what+", only when it was used", keyLabels),
+		overdue:  newDesc("rotation_overdue", "Whether this "+what+" is older than rotation_days", keyLabels),
+	}
+}
+
+type keyCollector struct {
+	config *config.KeyCollectorConfig
+	feed   *repositoryFeed
+	// for drop_user_series, nil when no team is defined. ssh keys are not
+	// aggregated per team, only those of the authenticated user are known
+	teams *teamCollector
+	// keyed by repository uuid
+	deployKeys *DataHolder[map[string]keyOwnerData]
+	// ssh keys of the authenticated user, Bitbucket returns no other user's
+	sshKeys *DataHolder[keyOwnerData]
+}
+
+func NewKeyCollector(
+	config *config.KeyCollectorConfig,
+	feed *repositoryFeed,
+	teams *teamCollector,
+) *keyCollector {
+	return &keyCollector{
+		config: config,
+		feed:   feed,
+		teams:  teams,
+		deployKeys: &DataHolder[map[string]keyOwnerData]{
+			data: map[string]keyOwnerData{},
+		},
+		sshKeys: &DataHolder[keyOwnerData]{},
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *keyCollector) Collect(ch chan<- prometheus.Metric) {
+	c.deployKeys.Lock()
+	for _, v := range c.deployKeys.data {
+		c.collectKeys(ch, deployKeyDescs, v, []string{v.Workspace, v.Project, v.Repository})
+	}
+	c.deployKeys.Unlock()
+
+	c.sshKeys.Lock()
+	// empty until the keys are collected
+	if v := c.sshKeys.data; v.UserUuid != "" && !c.teams.dropUserSeries() {
+		c.collectKeys(ch, sshKeyDescs, v, []string{v.User})
+	}
+	c.sshKeys.Unlock()
+}
+
+func (c *keyCollector) collectKeys(ch chan<- prometheus.Metric, descs keyDescs, v keyOwnerData, labels []string) {
+	now := time.Now()
+	ch <- prometheus.MustNewConstMetric(
+		descs.total,
+		prometheus.GaugeValue,
+		float64(len(v.Keys)),
+		labels...,
+	)
+	for _, key := range v.Keys {
+		keyLabels := append(append([]string{}, labels...), key.Id, key.Label, key.Type, strconv.Itoa(key.Bits))
+		age := now.Sub(key.CreatedOn)
+		ch <- prometheus.MustNewConstMetric(
+			descs.age,
+			prometheus.GaugeValue,
+			age.Seconds(),
+			keyLabels...,
+		)
+		if !key.LastUsed.IsZero() {
+			ch <- prometheus.MustNewConstMetric(
+				descs.lastUsed,
+				prometheus.GaugeValue,
+				float64(key.LastUsed.Unix()),
+				keyLabels...,
+			)
+		}
+		if c.config.RotationDays > 0 {
+			ch <- prometheus.MustNewConstMetric(
+				descs.overdue,
+				prometheus.GaugeValue,
+				helpers.BoolToFloat(key.CreatedOn.Before(now.AddDate(0, 0, -c.config.RotationDays))),
+				keyLabels...,
+			)
+		}
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *keyCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, descs := range []keyDescs{deployKeyDescs, sshKeyDescs} {
+		ch <- descs.total
+		ch <- descs.age
+		ch <- descs.lastUsed
+		ch <- descs.overdue
+	}
+}
+
+func (c *keyCollector) dataHolders() map[string]holder {
+	return map[string]holder{"deploy_keys": c.deployKeys, "ssh_keys": c.sshKeys}
+}
+
+func (c *keyCollector) repositoryCount() int {
+	c.deployKeys.Lock()
+	defer c.deployKeys.Unlock()
+	return len(c.deployKeys.data)
+}
+
+func (c *keyCollector) Exec(ctx context.Context, instance *instance) error {
+	var wg sync.WaitGroup
+	var userErr error
+
+	if c.config.CollectUserKeys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			userErr = c.collectUserKeys(ctx, instance)
+		}()
+	}
+
+	err := collectRepositories(
+		c.feed,
+		keyKeyCollector,
+		func(repo Repository) bool {
+			return includesRepository(c.config.IncludedRepository, repo)
+		},
+		c.deployKeys,
+		"deploy keys",
+		func(repo Repository) (keyOwnerData, error) {
+			return c.getDeployKeys(ctx, instance, repo)
+		},
+	)
+
+	// wait until keys of the user collected
+	wg.Wait()
+	return errors.Join(userErr, err)
+}
+
+func (c *keyCollector) getDeployKeys(
+	ctx context.Context,
+	instance *instance,
+	repo Repository,
+) (keyOwnerData, error) {
+	data := keyOwnerData{
+		Workspace:  repo.Workspace.Slug,
+		Project:    repo.Project.Key,
+		Repository: repo.Slug,
+	}
+
+	pathParams := map[string]string{":workspace": repo.Workspace.Slug, ":repo_slug": repo.Slug}
+	err := getAllPages(
+		ctx,
+		instance,
+		deployKeysEndpoint,
+		pathParams,
+		map[string]string{"pagelen": "100"},
+		func(values []DeployKey) error {
+			for _, v := range values {
+				keyType, bits := parsePublicKey(v.Key)
+				data.Keys = append(data.Keys, keyData{
+					Id:        strconv.FormatUint(v.Id, 10),
+					Label:     v.Label,
+					Type:      keyType,
+					Bits:      bits,
+					CreatedOn: v.CreatedOn,
+					LastUsed:  v.LastUsed,
+				})
+			}
+			return nil
+		},
+	)
+	return data, err
+}
+
+// collectUserKeys collects the ssh keys of the authenticated user.
+//
+// Bitbucket answers 403 for the ssh keys of any other user, so the keys of
+// the workspace members cannot be listed.
+func (c *keyCollector) collectUserKeys(ctx context.Context, instance *instance) error {
+	var user User
+	err := instance.GET(ctx, currentUserEndpoint, map[string]string{}, map[string]string{}, &user)
+	if err != nil {
+		return fmt.Errorf("error collecting authenticated user: %w", err)
+	}
+
+	data := keyOwnerData{User: user.Nickname, UserUuid: user.Uuid}
+	err = getAllPages(
+		ctx,
+		instance,
+		userSSHKeysEndpoint,
+		map[string]string{":user": url.PathEscape(user.Uuid)},
+		map[string]string{"pagelen": "100"},
+		func(values []SSHKey) error {
+			for _, v := range values {
+				keyType, bits := parsePublicKey(v.Key)
+				data.Keys = append(data.Keys, keyData{
+					Id:        v.Uuid,
+					Label:     v.Label,
+					Type:      keyType,
+					Bits:      bits,
+					CreatedOn: v.CreatedOn,
+					LastUsed:  v.LastUsed,
+				})
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("error collecting ssh keys of %s: %w", user.Nickname, err)
+	}
+
+	c.sshKeys.Lock()
+	c.sshKeys.data = data
+	c.sshKeys.touch()
+	c.sshKeys.Unlock()
+	return nil
+}
+
+// parsePublicKey returns the type and size in bits of an OpenSSH public
+// key, size is zero when unknown.
+func parsePublicKey(key string) (string, int) {
+	fields := strings.Fields(key)
+	if len(fields) == 0 {
+		return "", 0
+	}
+	keyType := fields[0]
+
+	switch keyType {
+	case "ssh-ed25519", "sk-ssh-ed25519@openssh.com":
+		return keyType, 256
+	case "ecdsa-sha2-nistp256", "sk-ecdsa-sha2-nistp256@openssh.com":
+		return keyType, 256
+	case "ecdsa-sha2-nistp384":
+		return keyType, 384
+	case "ecdsa-sha2-nistp521":
+		return keyType, 521
+	case "ssh-dss":
+		return keyType, 1024
+	case "ssh-rsa":
+		// size read from the modulus below
+	default:
+		return keyType, 0
+	}
+
+	if len(fields) < 2 {
+		return keyType, 0
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return keyType, 0
+	}
+	// the blob is the type, the exponent and the modulus, each prefixed
+	// with its length
+	var parts [][]byte
+	for len(blob) >= 4 && len(parts) < 3 {
+		size := binary.BigEndian.Uint32(blob)
+		if uint64(len(blob)-4) < uint64(size) {
+			return keyType, 0
+		}
+		parts = append(parts, blob[4:4+size])
+		blob = blob[4+size:]
+	}
+	if len(parts) < 3 {
+		return keyType, 0
+	}
+	return keyType, new(big.Int).SetBytes(parts[2]).BitLen()
+}
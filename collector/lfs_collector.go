@@ -0,0 +1,258 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"slices"
+	"strconv"
+
+	"github.com/nandanurseptama/bitbucket-exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// depth of the source tree walked for LFS files
+const lfsMaxDepth = 100
+
+type lfsData struct {
+	Workspace  string `json:"workspace"`
+	Project    string `json:"project"`
+	Repository string `json:"repository"`
+	// LFS files at the head of the main branch
+	Files uint64 `json:"files"`
+	Size  uint64 `json:"size"`
+}
+
+var (
+	lfsLabels = []string{"workspace", "project", "repository"}
+
+	lfsFilesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemLFS,
+			"files",
+		),
+		"Total Git LFS file at the head of the main branch of this repo",
+		lfsLabels,
+		nil,
+	)
+	lfsSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemLFS,
+			"size_bytes",
+		),
+		"Size of the Git LFS files at the head of the main branch of this repo, older versions kept in LFS storage are not counted",
+		lfsLabels,
+		nil,
+	)
+	lfsWorkspaceFilesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemLFS,
+			"workspace_files",
+		),
+		"Total Git LFS file at the head of the main branch of the collected repos of this workspace",
+		[]string{"workspace"},
+		nil,
+	)
+	lfsWorkspaceSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemLFS,
+			"workspace_size_bytes",
+		),
+		"Size of the Git LFS files at the head of the main branch of the collected repos of this workspace",
+		[]string{"workspace"},
+		nil,
+	)
+	lfsWorkspaceQuotaDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemLFS,
+			"workspace_quota_bytes",
+		),
+		"Git LFS storage of this workspace, from storage_quota_gb or the plan in workspace_collector",
+		[]string{"workspace"},
+		nil,
+	)
+)
+
+type lfsCollector struct {
+	config *config.LFSCollectorConfig
+	// plans of the workspaces, for the storage of those without a quota
+	workspaces *config.WorkspaceCollectorConfig
+	feed       *repositoryFeed
+	// keyed by repository uuid
+	holders *DataHolder[map[string]lfsData]
+}
+
+func NewLFSCollector(
+	config *config.LFSCollectorConfig,
+	workspaces *config.WorkspaceCollectorConfig,
+	feed *repositoryFeed,
+) *lfsCollector {
+	return &lfsCollector{
+		config:     config,
+		workspaces: workspaces,
+		feed:       feed,
+		holders: &DataHolder[map[string]lfsData]{
+			data: map[string]lfsData{},
+		},
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *lfsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+
+	workspaceFiles := map[string]uint64{}
+	workspaceSize := map[string]uint64{}
+	for _, v := range c.holders.data {
+		labels := []string{v.Workspace, v.Project, v.Repository}
+		ch <- prometheus.MustNewConstMetric(
+			lfsFilesDesc,
+			prometheus.GaugeValue,
+			float64(v.Files),
+			labels...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			lfsSizeDesc,
+			prometheus.GaugeValue,
+			float64(v.Size),
+			labels...,
+		)
+		workspaceFiles[v.Workspace] += v.Files
+		workspaceSize[v.Workspace] += v.Size
+	}
+
+	for workspace, files := range workspaceFiles {
+		ch <- prometheus.MustNewConstMetric(
+			lfsWorkspaceFilesDesc,
+			prometheus.GaugeValue,
+			float64(files),
+			workspace,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			lfsWorkspaceSizeDesc,
+			prometheus.GaugeValue,
+			float64(workspaceSize[workspace]),
+			workspace,
+		)
+		if quota := c.quotaGB(workspace); quota > 0 {
+			ch <- prometheus.MustNewConstMetric(
+				lfsWorkspaceQuotaDesc,
+				prometheus.GaugeValue,
+				quota*(1<<30),
+				workspace,
+			)
+		}
+	}
+}
+
+// quotaGB returns the Git LFS storage of workspace, zero when unknown.
+func (c *lfsCollector) quotaGB(workspace string) float64 {
+	if quota := c.config.StorageQuotaGB[workspace]; quota > 0 {
+		return quota
+	}
+	if plan := c.workspaces.Plan(workspace); plan != nil {
+		return plans[plan.Plan].lfsStorageGB
+	}
+	return 0
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *lfsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lfsFilesDesc
+	ch <- lfsSizeDesc
+	ch <- lfsWorkspaceFilesDesc
+	ch <- lfsWorkspaceSizeDesc
+	ch <- lfsWorkspaceQuotaDesc
+}
+
+func (c *lfsCollector) dataHolders() map[string]holder {
+	return map[string]holder{"repositories": c.holders}
+}
+
+func (c *lfsCollector) repositoryCount() int {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+	return len(c.holders.data)
+}
+
+func (c *lfsCollector) Exec(ctx context.Context, instance *instance) error {
+	return collectRepositories(
+		c.feed,
+		keyLFSCollector,
+		func(repo Repository) bool {
+			return includesRepository(c.config.IncludedRepository, repo)
+		},
+		c.holders,
+		"lfs usage",
+		func(repo Repository) (lfsData, error) {
+			return getLFSUsage(ctx, instance, repo)
+		},
+	)
+}
+
+// getLFSUsage sums the LFS files of the source tree at the head of the main
+// branch of repo.
+//
+// The API does not expose the LFS storage of a repository, so the objects
+// only referenced by older commits are not counted.
+func getLFSUsage(ctx context.Context, instance *instance, repo Repository) (lfsData, error) {
+	data := lfsData{
+		Workspace:  repo.Workspace.Slug,
+		Project:    repo.Project.Key,
+		Repository: repo.Slug,
+	}
+
+	// empty repository has no file
+	if repo.MainBranch == nil || repo.MainBranch.Name == "" {
+		return data, nil
+	}
+
+	head, err := getMainBranchHead(ctx, instance, repo)
+	if err != nil {
+		return data, err
+	}
+
+	err = getAllPages(
+		ctx,
+		instance,
+		srcRepositoryEndpoint,
+		map[string]string{
+			":workspace": repo.Workspace.Slug,
+			":repo_slug": repo.Slug,
+			":commit":    head.Hash,
+		},
+		map[string]string{
+			"pagelen":   "100",
+			"max_depth": strconv.Itoa(lfsMaxDepth),
+			"q":         `attributes="lfs"`,
+		},
+		func(values []TreeEntry) error {
+			for _, v := range values {
+				if v.Type != "commit_file" || !slices.Contains(v.Attributes, "lfs") {
+					continue
+				}
+				data.Files++
+				data.Size += v.Size
+			}
+			return nil
+		},
+	)
+	return data, err
+}
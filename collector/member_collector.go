@@ -15,7 +15,6 @@ package collector
 
 import (
 	"context"
-	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -24,6 +23,11 @@ import (
 type memberCollector struct {
 	workspaces []string
 	holders    *DataHolder[map[string]uint64]
+	// list every member, only for the collectors reading them, counting
+	// takes a single request
+	listMembers bool
+	// members keyed by workspace slug, empty unless listMembers
+	members *DataHolder[map[string][]User]
 }
 
 var (
@@ -40,12 +44,16 @@ var (
 	)
 )
 
-func NewMemberCollector(workspaces []string) *memberCollector {
+func NewMemberCollector(workspaces []string, listMembers bool) *memberCollector {
 	return &memberCollector{
-		workspaces: workspaces,
+		workspaces:  workspaces,
+		listMembers: listMembers,
 		holders: &DataHolder[map[string]uint64]{
 			data: map[string]uint64{},
 		},
+		members: &DataHolder[map[string][]User]{
+			data: map[string][]User{},
+		},
 	}
 }
 
@@ -67,22 +75,87 @@ func (c *memberCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- bitbucketTotalMemberDesc
 }
 
+func (c *memberCollector) dataHolders() map[string]holder {
+	return map[string]holder{"total_member": c.holders, "members": c.members}
+}
+
 func (c *memberCollector) Exec(ctx context.Context, instance *instance) error {
 	for _, workspace := range c.workspaces {
 
 		var responsebody PaginationResponse[any]
-		endpoint := strings.ReplaceAll(workspaceMembersEndpoint, ":workspace", workspace)
-		err := instance.GET(ctx, endpoint, map[string]string{}, &responsebody)
+		err := instance.GET(
+			ctx,
+			workspaceMembersEndpoint,
+			map[string]string{":workspace": workspace},
+			map[string]string{},
+			&responsebody,
+		)
 
 		if err != nil {
 			return err
 		}
 		c.holders.Lock()
 		c.holders.data[workspace] = responsebody.Size
+		c.holders.touch()
 		c.holders.Unlock()
 
+		if c.listMembers {
+			members, err := getWorkspaceMembers(ctx, instance, workspace)
+			if err != nil {
+				return err
+			}
+			c.members.Lock()
+			c.members.data[workspace] = members
+			c.members.touch()
+			c.members.Unlock()
+		}
+
 		time.Sleep(time.Second * 5)
 	}
 
 	return nil
 }
+
+// getWorkspaceMembers returns every member of workspace.
+func getWorkspaceMembers(ctx context.Context, instance *instance, workspace string) ([]User, error) {
+	var members []User
+	err := getAllPages(
+		ctx,
+		instance,
+		workspaceMembersEndpoint,
+		map[string]string{":workspace": workspace},
+		map[string]string{"pagelen": "100"},
+		func(values []WorkspaceMembership) error {
+			for _, v := range values {
+				members = append(members, v.User)
+			}
+			return nil
+		},
+	)
+	return members, err
+}
+
+// memberCount returns the total member of workspace, known is false until
+// the members of workspace are collected.
+func (c *memberCollector) memberCount(workspace string) (total uint64, known bool) {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+
+	total, known = c.holders.data[workspace]
+	return total, known
+}
+
+// hasMember reports whether user, a nickname or uuid, is a member of
+// workspace. known is false until the members of workspace are collected.
+func (c *memberCollector) hasMember(workspace, user string) (member bool, known bool) {
+	c.members.Lock()
+	defer c.members.Unlock()
+
+	members, known := c.members.data[workspace]
+	for _, v := range members {
+		if v.Nickname == user || v.Uuid == user {
+			return true, known
+		}
+	}
+	return false, known
+}
@@ -0,0 +1,550 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/nandanurseptama/bitbucket-exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// default of lookback_days
+	defaultPipelineLookbackDays = 7
+	// default of max_pipelines
+	defaultMaxPipelines = 100
+	// name of a step without one
+	defaultStepName = "default"
+)
+
+var (
+	// upper bounds of step duration, in seconds: 30s, 1m, 2m, 5m, 10m, 20m, 30m, 1h
+	stepDurationBuckets = []float64{30, 60, 120, 300, 600, 1200, 1800, 3600}
+	// upper bounds of step wait, in seconds: 5s, 15s, 30s, 1m, 2m, 5m, 10m, 30m
+	stepWaitBuckets = []float64{5, 15, 30, 60, 120, 300, 600, 1800}
+
+	// step results counted as a failure
+	failedStepResults = []string{"FAILED", "ERROR"}
+)
+
+type stepData struct {
+	// total run keyed by result
+	Results  map[string]uint64 `json:"results"`
+	Duration histogramData     `json:"duration"`
+	Wait     histogramData     `json:"wait"`
+	// image of the most recent run
+	Image string `json:"image"`
+}
+
+// stepSummary is a completed step of a completed pipeline.
+type stepSummary struct {
+	Uuid   string `json:"uuid"`
+	Name   string `json:"name"`
+	Result string `json:"result"`
+	// false for a step not run, which has no image nor timing
+	Started         bool    `json:"started"`
+	Image           string  `json:"image"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	WaitSeconds     float64 `json:"wait_seconds"`
+	// nil until fetched, only when collect_test_reports is set
+	TestReport *stepTestReport `json:"test_report"`
+}
+
+type pipelineData struct {
+	Workspace  string `json:"workspace"`
+	Project    string `json:"project"`
+	Repository string `json:"repository"`
+	// steps of the pipelines inside the lookback, keyed by step name, with
+	// Duration and Wait observed across runs
+	Steps map[string]*stepData `json:"steps"`
+	// pipelines completed up to this time are already observed
+	ObservedUntil time.Time `json:"observed_until"`
+	// completed steps of the pipelines inside the lookback, keyed by
+	// pipeline uuid, so the steps of a pipeline are fetched once
+	Pipelines map[string][]stepSummary `json:"pipelines"`
+	// flaky step ever seen, keyed by step name
+	FlakyTotal map[string]uint64 `json:"flaky_total"`
+	// commit and step of the flaky steps already counted, with the creation
+	// of the passing pipeline, forgotten once out of the lookback
+	FlakySeen map[string]time.Time `json:"flaky_seen"`
+	// test reports of the most recent pipeline with one, keyed by branch
+	TestReports map[string]testReportData `json:"test_reports"`
+	// most failing and most flaky test cases inside the lookback
+	TestCaseFailures map[string]uint64 `json:"test_case_failures"`
+	TestCaseFlaky    map[string]uint64 `json:"test_case_flaky"`
+}
+
+var (
+	pipelineStepLabels = []string{"workspace", "project", "repository", "step"}
+
+	pipelineStepRunsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPipelineStep,
+			"runs",
+		),
+		"Total run of this step inside lookback_days by result",
+		append(pipelineStepLabels, "result"),
+		nil,
+	)
+	pipelineStepFailureRatioDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPipelineStep,
+			"failure_ratio",
+		),
+		"Ratio of FAILED or ERROR runs of this step inside lookback_days",
+		pipelineStepLabels,
+		nil,
+	)
+	pipelineStepDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPipelineStep,
+			"duration_seconds",
+		),
+		"Duration of this step, observed once its pipeline is completed",
+		pipelineStepLabels,
+		nil,
+	)
+	pipelineStepWaitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPipelineStep,
+			"wait_seconds",
+		),
+		"Time this step waited for a runner, observed once its pipeline is completed",
+		pipelineStepLabels,
+		nil,
+	)
+	pipelineStepImageDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPipelineStep,
+			"image",
+		),
+		"Image of the most recent run of this step",
+		append(pipelineStepLabels, "image"),
+		nil,
+	)
+	pipelineStepFlakyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPipelineStep,
+			"flaky_total",
+		),
+		"Total time this step failed and then passed on the same commit",
+		pipelineStepLabels,
+		nil,
+	)
+)
+
+type pipelineCollector struct {
+	config *config.PipelineCollectorConfig
+	feed   *repositoryFeed
+	// keyed by repository uuid
+	holders *DataHolder[map[string]pipelineData]
+}
+
+func NewPipelineCollector(config *config.PipelineCollectorConfig, feed *repositoryFeed) *pipelineCollector {
+	return &pipelineCollector{
+		config: config,
+		feed:   feed,
+		holders: &DataHolder[map[string]pipelineData]{
+			data: map[string]pipelineData{},
+		},
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *pipelineCollector) Collect(ch chan<- prometheus.Metric) {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+
+	for _, v := range c.holders.data {
+		for name, step := range v.Steps {
+			labels := []string{v.Workspace, v.Project, v.Repository, name}
+
+			var runs, failed uint64
+			for result, total := range step.Results {
+				runs += total
+				if slices.Contains(failedStepResults, result) {
+					failed += total
+				}
+				ch <- prometheus.MustNewConstMetric(
+					pipelineStepRunsDesc,
+					prometheus.GaugeValue,
+					float64(total),
+					append(labels, result)...,
+				)
+			}
+			if runs > 0 {
+				ch <- prometheus.MustNewConstMetric(
+					pipelineStepFailureRatioDesc,
+					prometheus.GaugeValue,
+					float64(failed)/float64(runs),
+					labels...,
+				)
+			}
+
+			ch <- step.Duration.metric(pipelineStepDurationDesc, stepDurationBuckets, labels...)
+			ch <- step.Wait.metric(pipelineStepWaitDesc, stepWaitBuckets, labels...)
+			if step.Image != "" {
+				ch <- prometheus.MustNewConstMetric(
+					pipelineStepImageDesc,
+					prometheus.GaugeValue,
+					1,
+					append(labels, step.Image)...,
+				)
+			}
+		}
+
+		for name, total := range v.FlakyTotal {
+			ch <- prometheus.MustNewConstMetric(
+				pipelineStepFlakyDesc,
+				prometheus.CounterValue,
+				float64(total),
+				v.Workspace, v.Project, v.Repository, name,
+			)
+		}
+
+		collectTestReports(ch, v)
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *pipelineCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pipelineStepRunsDesc
+	ch <- pipelineStepFailureRatioDesc
+	ch <- pipelineStepDurationDesc
+	ch <- pipelineStepWaitDesc
+	ch <- pipelineStepImageDesc
+	ch <- pipelineStepFlakyDesc
+	ch <- pipelineTestCasesDesc
+	ch <- pipelineTestCaseFailuresDesc
+	ch <- pipelineTestCaseFlakyDesc
+}
+
+func (c *pipelineCollector) dataHolders() map[string]holder {
+	return map[string]holder{"repositories": c.holders}
+}
+
+func (c *pipelineCollector) repositoryCount() int {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+	return len(c.holders.data)
+}
+
+func (c *pipelineCollector) Exec(ctx context.Context, instance *instance) error {
+	return collectRepositories(
+		c.feed,
+		keyPipelineCollector,
+		func(repo Repository) bool {
+			return includesRepository(c.config.IncludedRepository, repo)
+		},
+		c.holders,
+		"pipelines",
+		func(repo Repository) (pipelineData, error) {
+			return c.getPipelines(ctx, instance, repo)
+		},
+	)
+}
+
+// stepRun is a completed step of a pipeline, used to find flaky steps.
+type stepRun struct {
+	commit    string
+	step      string
+	failed    bool
+	createdOn time.Time
+}
+
+func (c *pipelineCollector) getPipelines(
+	ctx context.Context,
+	instance *instance,
+	repo Repository,
+) (pipelineData, error) {
+	lookbackDays := c.config.LookbackDays
+	if lookbackDays <= 0 {
+		lookbackDays = defaultPipelineLookbackDays
+	}
+	maxPipelines := c.config.MaxPipelines
+	if maxPipelines <= 0 {
+		maxPipelines = defaultMaxPipelines
+	}
+	now := time.Now()
+	since := now.AddDate(0, 0, -lookbackDays)
+
+	data := pipelineData{
+		Workspace:   repo.Workspace.Slug,
+		Project:     repo.Project.Key,
+		Repository:  repo.Slug,
+		Steps:       map[string]*stepData{},
+		Pipelines:   map[string][]stepSummary{},
+		FlakyTotal:  map[string]uint64{},
+		FlakySeen:   map[string]time.Time{},
+		TestReports: map[string]testReportData{},
+	}
+	// flaky steps and step timings are counted across runs
+	var observedUntil time.Time
+	var previousPipelines map[string][]stepSummary
+	c.holders.Lock()
+	if previous, ok := c.holders.data[repo.Uuid]; ok {
+		observedUntil = previous.ObservedUntil
+		previousPipelines = previous.Pipelines
+		for name, step := range previous.Steps {
+			data.Steps[name] = &stepData{
+				Results:  map[string]uint64{},
+				Duration: step.Duration.clone(),
+				Wait:     step.Wait.clone(),
+			}
+		}
+		for name, total := range previous.FlakyTotal {
+			data.FlakyTotal[name] = total
+		}
+		for key, createdOn := range previous.FlakySeen {
+			if createdOn.After(since) {
+				data.FlakySeen[key] = createdOn
+			}
+		}
+	}
+	c.holders.Unlock()
+
+	pathParams := map[string]string{":workspace": repo.Workspace.Slug, ":repo_slug": repo.Slug}
+
+	var pipelines []Pipeline
+	err := getAllPages(
+		ctx,
+		instance,
+		pipelinesEndpoint,
+		pathParams,
+		map[string]string{"pagelen": "100", "sort": "-created_on"},
+		func(values []Pipeline) error {
+			for _, v := range values {
+				if v.CreatedOn.Before(since) || len(pipelines) >= maxPipelines {
+					return errLastPage
+				}
+				if v.State.Name == "COMPLETED" {
+					pipelines = append(pipelines, v)
+				}
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return data, err
+	}
+
+	var runs []stepRun
+	var testRuns []testRun
+	for _, pipeline := range pipelines {
+		// pipelines completed after the previous run are observed once
+		observe := pipeline.CompletedOn.After(observedUntil) && !pipeline.CompletedOn.After(now)
+
+		// steps of a completed pipeline do not change
+		steps, ok := previousPipelines[pipeline.Uuid]
+		if !ok {
+			var err error
+			steps, err = c.getSteps(ctx, instance, repo, pipeline)
+			if err != nil {
+				return data, err
+			}
+		} else {
+			// the previous data is read concurrently, test reports are
+			// filled in a copy
+			steps = slices.Clone(steps)
+		}
+		data.Pipelines[pipeline.Uuid] = steps
+
+		// test report of the whole pipeline
+		var pipelineReport *testReportData
+
+		for i, step := range steps {
+			name := step.Name
+			result := step.Result
+
+			v := data.Steps[name]
+			if v == nil {
+				v = &stepData{
+					Results:  map[string]uint64{},
+					Duration: newHistogramData(stepDurationBuckets),
+					Wait:     newHistogramData(stepWaitBuckets),
+				}
+				data.Steps[name] = v
+			}
+			v.Results[result]++
+
+			// a step not run has no timing
+			if !step.Started {
+				continue
+			}
+			// pipelines are newest first, the first image seen is the latest
+			if v.Image == "" {
+				v.Image = step.Image
+			}
+			if observe {
+				v.Duration.observe(stepDurationBuckets, step.DurationSeconds)
+				v.Wait.observe(stepWaitBuckets, step.WaitSeconds)
+			}
+
+			runs = append(runs, stepRun{
+				commit:    pipeline.Target.Commit.Hash,
+				step:      name,
+				failed:    slices.Contains(failedStepResults, result),
+				createdOn: pipeline.CreatedOn,
+			})
+
+			if !c.config.CollectTestReports {
+				continue
+			}
+			// the test report of a completed step does not change
+			if step.TestReport == nil {
+				report, err := getTestReport(ctx, instance, repo, pipeline, step.Uuid)
+				if err != nil {
+					return data, err
+				}
+				steps[i].TestReport = &report
+			}
+			report := steps[i].TestReport
+			if !report.Published {
+				continue
+			}
+			if pipelineReport == nil {
+				pipelineReport = &testReportData{}
+			}
+			pipelineReport.add(report.Report)
+			testRuns = append(testRuns, testRun{
+				commit:    pipeline.Target.Commit.Hash,
+				step:      name,
+				createdOn: pipeline.CreatedOn,
+				failed:    report.Failed,
+			})
+		}
+
+		// pipelines are newest first, keep the first report of a branch
+		branch := pipeline.Target.RefName
+		if _, ok := data.TestReports[branch]; pipelineReport != nil && branch != "" && !ok {
+			data.TestReports[branch] = *pipelineReport
+		}
+	}
+
+	countFlakySteps(&data, runs)
+	if c.config.CollectTestReports {
+		topTestCases := c.config.TopTestCases
+		if topTestCases <= 0 {
+			topTestCases = defaultTopTestCases
+		}
+		countTestCases(&data, testRuns, topTestCases)
+	}
+	data.ObservedUntil = now
+	return data, nil
+}
+
+// getSteps returns the completed steps of pipeline.
+func (c *pipelineCollector) getSteps(
+	ctx context.Context,
+	instance *instance,
+	repo Repository,
+	pipeline Pipeline,
+) ([]stepSummary, error) {
+	pathParams := map[string]string{
+		":workspace": repo.Workspace.Slug,
+		":repo_slug": repo.Slug,
+		":pipeline":  url.PathEscape(pipeline.Uuid),
+	}
+
+	var steps []PipelineStep
+	err := getAllPages(
+		ctx,
+		instance,
+		pipelineStepsEndpoint,
+		pathParams,
+		map[string]string{"pagelen": "100"},
+		func(values []PipelineStep) error {
+			steps = append(steps, values...)
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var summaries []stepSummary
+	for _, step := range steps {
+		if step.State.Name != "COMPLETED" {
+			continue
+		}
+		name := step.Name
+		if name == "" {
+			name = defaultStepName
+		}
+		summary := stepSummary{
+			Uuid:   step.Uuid,
+			Name:   name,
+			Result: step.State.Result.Name,
+		}
+		if !step.StartedOn.IsZero() {
+			summary.Started = true
+			summary.Image = step.Image.Name
+			summary.DurationSeconds = step.DurationInSeconds
+			summary.WaitSeconds = stepWait(step, pipeline, steps).Seconds()
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// stepWait returns the time step waited for a runner: from the latest of
+// the pipeline creation and the completion of a step before it, to its start.
+func stepWait(step PipelineStep, pipeline Pipeline, steps []PipelineStep) time.Duration {
+	ready := pipeline.CreatedOn
+	for _, other := range steps {
+		if other.CompletedOn.After(ready) && !other.CompletedOn.After(step.StartedOn) {
+			ready = other.CompletedOn
+		}
+	}
+	if wait := step.StartedOn.Sub(ready); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// countFlakySteps counts the steps that failed and then passed on the same
+// commit, each commit and step once.
+func countFlakySteps(data *pipelineData, runs []stepRun) {
+	// oldest first
+	slices.SortStableFunc(runs, func(a, b stepRun) int {
+		return a.createdOn.Compare(b.createdOn)
+	})
+
+	failed := map[string]bool{}
+	for _, run := range runs {
+		key := run.commit + "/" + run.step
+		if run.failed {
+			failed[key] = true
+			continue
+		}
+		if !failed[key] {
+			continue
+		}
+		if _, ok := data.FlakySeen[key]; ok {
+			continue
+		}
+		data.FlakySeen[key] = run.createdOn
+		data.FlakyTotal[run.step]++
+	}
+}
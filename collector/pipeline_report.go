@@ -0,0 +1,242 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// default of top_test_cases
+const defaultTopTestCases = 10
+
+// test case statuses counted as a failure
+var failedTestCaseStatuses = []string{"FAILED", "ERROR"}
+
+// total test case of the pipelines of a branch
+type testReportData struct {
+	Passed  uint64 `json:"passed"`
+	Failed  uint64 `json:"failed"`
+	Skipped uint64 `json:"skipped"`
+	Error   uint64 `json:"error"`
+}
+
+func (r *testReportData) add(report testReportData) {
+	r.Passed += report.Passed
+	r.Failed += report.Failed
+	r.Skipped += report.Skipped
+	r.Error += report.Error
+}
+
+// stepTestReport is the test report of a completed step, fetched once.
+type stepTestReport struct {
+	// false when the step published none
+	Published bool           `json:"published"`
+	Report    testReportData `json:"report"`
+	// failing test cases
+	Failed []string `json:"failed"`
+}
+
+// testRun is the test report of a step, used to find flaky test cases.
+type testRun struct {
+	commit    string
+	step      string
+	createdOn time.Time
+	// failing test cases
+	failed []string
+}
+
+var (
+	pipelineTestCasesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPipelineTest,
+			"cases",
+		),
+		"Total test case of the most recent pipeline of this branch with a test report, by status",
+		[]string{"workspace", "project", "repository", "branch", "status"},
+		nil,
+	)
+	pipelineTestCaseFailuresDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPipelineTest,
+			"case_failures",
+		),
+		"Total failure of this test case inside lookback_days, only the top_test_cases most failing",
+		[]string{"workspace", "project", "repository", "test"},
+		nil,
+	)
+	pipelineTestCaseFlakyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPipelineTest,
+			"case_flaky",
+		),
+		"Total time this test case failed and then passed on the same commit inside lookback_days, only the top_test_cases most flaky",
+		[]string{"workspace", "project", "repository", "test"},
+		nil,
+	)
+)
+
+func collectTestReports(ch chan<- prometheus.Metric, v pipelineData) {
+	for branch, report := range v.TestReports {
+		for status, total := range map[string]uint64{
+			"passed":  report.Passed,
+			"failed":  report.Failed,
+			"skipped": report.Skipped,
+			"error":   report.Error,
+		} {
+			ch <- prometheus.MustNewConstMetric(
+				pipelineTestCasesDesc,
+				prometheus.GaugeValue,
+				float64(total),
+				v.Workspace, v.Project, v.Repository, branch, status,
+			)
+		}
+	}
+	for test, total := range v.TestCaseFailures {
+		ch <- prometheus.MustNewConstMetric(
+			pipelineTestCaseFailuresDesc,
+			prometheus.GaugeValue,
+			float64(total),
+			v.Workspace, v.Project, v.Repository, test,
+		)
+	}
+	for test, total := range v.TestCaseFlaky {
+		ch <- prometheus.MustNewConstMetric(
+			pipelineTestCaseFlakyDesc,
+			prometheus.GaugeValue,
+			float64(total),
+			v.Workspace, v.Project, v.Repository, test,
+		)
+	}
+}
+
+// getTestReport returns the test report of the step stepUuid of pipeline.
+func getTestReport(
+	ctx context.Context,
+	instance *instance,
+	repo Repository,
+	pipeline Pipeline,
+	stepUuid string,
+) (stepTestReport, error) {
+	pathParams := map[string]string{
+		":workspace": repo.Workspace.Slug,
+		":repo_slug": repo.Slug,
+		":pipeline":  url.PathEscape(pipeline.Uuid),
+		":step":      url.PathEscape(stepUuid),
+	}
+
+	var report TestReport
+	err := instance.GET(ctx, stepTestReportsEndpoint, pathParams, map[string]string{}, &report)
+	if errors.Is(err, errNotFound) {
+		return stepTestReport{}, nil
+	}
+	if err != nil {
+		return stepTestReport{}, err
+	}
+
+	data := stepTestReport{
+		Published: true,
+		Report: testReportData{
+			Passed:  report.NumberOfSuccessfulTestCases,
+			Failed:  report.NumberOfFailedTestCases,
+			Skipped: report.NumberOfSkippedTestCases,
+			Error:   report.NumberOfErrorTestCases,
+		},
+	}
+	// only a failing report has test cases worth listing
+	if report.NumberOfFailedTestCases+report.NumberOfErrorTestCases == 0 {
+		return data, nil
+	}
+	err = getAllPages(
+		ctx,
+		instance,
+		stepTestCasesEndpoint,
+		pathParams,
+		map[string]string{"pagelen": "100"},
+		func(values []TestCase) error {
+			for _, v := range values {
+				if !slices.Contains(failedTestCaseStatuses, v.Status) {
+					continue
+				}
+				name := v.FullyQualifiedName
+				if name == "" {
+					name = v.Name
+				}
+				data.Failed = append(data.Failed, name)
+			}
+			return nil
+		},
+	)
+	return data, err
+}
+
+// countTestCases fills the most failing and most flaky test cases of data.
+func countTestCases(data *pipelineData, runs []testRun, top int) {
+	failures := map[string]uint64{}
+	flaky := map[string]uint64{}
+
+	// oldest first
+	slices.SortStableFunc(runs, func(a, b testRun) int {
+		return a.createdOn.Compare(b.createdOn)
+	})
+
+	// failing test cases keyed by commit and step
+	failing := map[string]map[string]bool{}
+	for _, run := range runs {
+		key := run.commit + "/" + run.step
+		current := map[string]bool{}
+		for _, test := range run.failed {
+			failures[test]++
+			current[test] = true
+		}
+		for test := range failing[key] {
+			if !current[test] {
+				flaky[test]++
+			}
+		}
+		failing[key] = current
+	}
+
+	data.TestCaseFailures = topValues(failures, top)
+	data.TestCaseFlaky = topValues(flaky, top)
+}
+
+// topValues returns the n entries of m with the highest value.
+func topValues(m map[string]uint64, n int) map[string]uint64 {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		if c := cmp.Compare(m[b], m[a]); c != 0 {
+			return c
+		}
+		return cmp.Compare(a, b)
+	})
+
+	top := map[string]uint64{}
+	for _, key := range keys[:min(n, len(keys))] {
+		top[key] = m[key]
+	}
+	return top
+}
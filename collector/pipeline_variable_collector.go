@@ -0,0 +1,298 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nandanurseptama/bitbucket-exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// default of secret_patterns
+var defaultSecretPatterns = []string{"TOKEN", "PASSWORD", "SECRET", "KEY"}
+
+// name and secured flag of a variable, its value is never read
+type variableData struct {
+	// deployment environment, empty for repository and workspace variables
+	Environment string `json:"environment"`
+	Name        string `json:"name"`
+	Secured     bool   `json:"secured"`
+}
+
+type pipelineVariableData struct {
+	Workspace string `json:"workspace"`
+	// project and repository are empty for workspace variables
+	Project    string         `json:"project"`
+	Repository string         `json:"repository"`
+	Variables  []variableData `json:"variables"`
+}
+
+var (
+	pipelineVariableLabels = []string{"workspace", "project", "repository", "environment"}
+
+	pipelineVariableTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPipelineVar,
+			"total",
+		),
+		"Total pipeline variable of this repo, deployment environment or workspace",
+		append(pipelineVariableLabels, "secured"),
+		nil,
+	)
+	pipelineVariableUnsecuredSecretDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPipelineVar,
+			"unsecured_secret",
+		),
+		"Unsecured pipeline variable whose name looks like a secret",
+		append(pipelineVariableLabels, "variable"),
+		nil,
+	)
+)
+
+type pipelineVariableCollector struct {
+	config     *config.PipelineVariableCollectorConfig
+	workspaces []string
+	feed       *repositoryFeed
+	// keyed by repository uuid
+	holders *DataHolder[map[string]pipelineVariableData]
+	// keyed by workspace slug
+	workspaceHolders *DataHolder[map[string]pipelineVariableData]
+}
+
+func NewPipelineVariableCollector(
+	config *config.PipelineVariableCollectorConfig,
+	workspaces []string,
+	feed *repositoryFeed,
+) *pipelineVariableCollector {
+	return &pipelineVariableCollector{
+		config:     config,
+		workspaces: workspaces,
+		feed:       feed,
+		holders: &DataHolder[map[string]pipelineVariableData]{
+			data: map[string]pipelineVariableData{},
+		},
+		workspaceHolders: &DataHolder[map[string]pipelineVariableData]{
+			data: map[string]pipelineVariableData{},
+		},
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *pipelineVariableCollector) Collect(ch chan<- prometheus.Metric) {
+	type totalKey struct {
+		environment string
+		secured     bool
+	}
+
+	for _, v := range holderValues(c.holders, c.workspaceHolders) {
+		totals := map[totalKey]uint64{}
+		for _, variable := range v.Variables {
+			totals[totalKey{environment: variable.Environment, secured: variable.Secured}]++
+
+			if !variable.Secured && c.looksSecret(variable.Name) {
+				ch <- prometheus.MustNewConstMetric(
+					pipelineVariableUnsecuredSecretDesc,
+					prometheus.GaugeValue,
+					1,
+					v.Workspace, v.Project, v.Repository, variable.Environment, variable.Name,
+				)
+			}
+		}
+
+		for key, total := range totals {
+			ch <- prometheus.MustNewConstMetric(
+				pipelineVariableTotalDesc,
+				prometheus.GaugeValue,
+				float64(total),
+				v.Workspace, v.Project, v.Repository, key.environment, strconv.FormatBool(key.secured),
+			)
+		}
+	}
+}
+
+// looksSecret reports whether a variable name contains one of secret_patterns.
+func (c *pipelineVariableCollector) looksSecret(name string) bool {
+	patterns := c.config.SecretPatterns
+	if len(patterns) == 0 {
+		patterns = defaultSecretPatterns
+	}
+	name = strings.ToUpper(name)
+	for _, pattern := range patterns {
+		if strings.Contains(name, strings.ToUpper(pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *pipelineVariableCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pipelineVariableTotalDesc
+	ch <- pipelineVariableUnsecuredSecretDesc
+}
+
+func (c *pipelineVariableCollector) dataHolders() map[string]holder {
+	return map[string]holder{"variables": c.holders, "workspace_variables": c.workspaceHolders}
+}
+
+func (c *pipelineVariableCollector) repositoryCount() int {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+	return len(c.holders.data)
+}
+
+func (c *pipelineVariableCollector) Exec(ctx context.Context, instance *instance) error {
+	var wg sync.WaitGroup
+	var workspaceErrs []error
+
+	if c.config.CollectWorkspaceVariables {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, workspace := range c.workspaces {
+				data := pipelineVariableData{Workspace: workspace}
+				variables, err := getPipelineVariables(
+					ctx,
+					instance,
+					workspaceVariablesEndpoint,
+					map[string]string{":workspace": workspace},
+					"",
+				)
+				if skippable(err) {
+					c.feed.logger.Info("skipping workspace", "collector", keyPipelineVarCollector, "workspace", workspace, "err", err)
+					c.workspaceHolders.Lock()
+					delete(c.workspaceHolders.data, workspace)
+					c.workspaceHolders.touch()
+					c.workspaceHolders.Unlock()
+					continue
+				}
+				if err != nil {
+					workspaceErrs = append(workspaceErrs, fmt.Errorf("error collecting pipeline variables of %s: %w", workspace, err))
+					continue
+				}
+				data.Variables = variables
+				c.workspaceHolders.Lock()
+				c.workspaceHolders.data[workspace] = data
+				c.workspaceHolders.touch()
+				c.workspaceHolders.Unlock()
+			}
+		}()
+	}
+
+	err := collectRepositories(
+		c.feed,
+		keyPipelineVarCollector,
+		func(repo Repository) bool {
+			return includesRepository(c.config.IncludedRepository, repo)
+		},
+		c.holders,
+		"pipeline variables",
+		func(repo Repository) (pipelineVariableData, error) {
+			return c.getRepositoryVariables(ctx, instance, repo)
+		},
+	)
+	// wait until variables of every workspace collected
+	wg.Wait()
+	return errors.Join(append(workspaceErrs, err)...)
+}
+
+func (c *pipelineVariableCollector) getRepositoryVariables(
+	ctx context.Context,
+	instance *instance,
+	repo Repository,
+) (pipelineVariableData, error) {
+	data := pipelineVariableData{
+		Workspace:  repo.Workspace.Slug,
+		Project:    repo.Project.Key,
+		Repository: repo.Slug,
+	}
+	pathParams := map[string]string{":workspace": repo.Workspace.Slug, ":repo_slug": repo.Slug}
+
+	variables, err := getPipelineVariables(ctx, instance, repositoryVariablesEndpoint, pathParams, "")
+	if err != nil {
+		return data, err
+	}
+	data.Variables = variables
+
+	var environments []Environment
+	err = getAllPages(
+		ctx,
+		instance,
+		environmentsEndpoint,
+		pathParams,
+		map[string]string{"pagelen": "100"},
+		func(values []Environment) error {
+			environments = append(environments, values...)
+			return nil
+		},
+	)
+	if err != nil {
+		return data, err
+	}
+
+	for _, environment := range environments {
+		environmentParams := map[string]string{
+			":workspace":   repo.Workspace.Slug,
+			":repo_slug":   repo.Slug,
+			":environment": url.PathEscape(environment.Uuid),
+		}
+		variables, err := getPipelineVariables(ctx, instance, environmentVariablesEndpoint, environmentParams, environment.Name)
+		if err != nil {
+			return data, err
+		}
+		data.Variables = append(data.Variables, variables...)
+	}
+
+	return data, nil
+}
+
+// getPipelineVariables returns name and secured flag of the variables at
+// endpoint, tagged with environment.
+func getPipelineVariables(
+	ctx context.Context,
+	instance *instance,
+	endpoint string,
+	pathParams map[string]string,
+	environment string,
+) ([]variableData, error) {
+	var variables []variableData
+	err := getAllPages(
+		ctx,
+		instance,
+		endpoint,
+		pathParams,
+		map[string]string{"pagelen": "100"},
+		func(values []PipelineVariable) error {
+			for _, v := range values {
+				variables = append(variables, variableData{
+					Environment: environment,
+					Name:        v.Key,
+					Secured:     v.Secured,
+				})
+			}
+			return nil
+		},
+	)
+	return variables, err
+}
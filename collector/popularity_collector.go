@@ -0,0 +1,238 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+
+	"github.com/nandanurseptama/bitbucket-exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// default weights of the popularity score
+const (
+	defaultCommitterWeight = 3
+	defaultWatcherWeight   = 1
+	defaultForkWeight      = 2
+)
+
+type popularityData struct {
+	Workspace  string `json:"workspace"`
+	Project    string `json:"project"`
+	Repository string `json:"repository"`
+	Watchers   uint64 `json:"watchers"`
+}
+
+var (
+	popularityLabels = []string{"workspace", "project", "repository"}
+
+	popularityWatchersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPopularity,
+			"watchers",
+		),
+		"Total watcher of this repo",
+		popularityLabels,
+		nil,
+	)
+	popularityForksDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPopularity,
+			"forks",
+		),
+		"Total fork of this repo, from the fork collector",
+		popularityLabels,
+		nil,
+	)
+	popularityCommittersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPopularity,
+			"committers",
+		),
+		"Distinct commit author of this repo in the last 90 days, from the commit collector",
+		popularityLabels,
+		nil,
+	)
+	popularityScoreDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPopularity,
+			"score",
+		),
+		"Inner-source popularity of this repo, committers, watchers and forks multiplied by their weight and summed, only for repos of both the commit and fork collectors",
+		popularityLabels,
+		nil,
+	)
+)
+
+type popularityCollector struct {
+	config *config.PopularityCollectorConfig
+	feed   *repositoryFeed
+	// committers are counted by its crawl, nil while disabled
+	commits *commitCollector
+	// forks are counted by its crawl, nil while disabled
+	forks *forkCollector
+	// keyed by repository uuid
+	holders *DataHolder[map[string]popularityData]
+}
+
+func NewPopularityCollector(
+	config *config.PopularityCollectorConfig,
+	feed *repositoryFeed,
+	commits *commitCollector,
+	forks *forkCollector,
+) *popularityCollector {
+	return &popularityCollector{
+		config:  config,
+		feed:    feed,
+		commits: commits,
+		forks:   forks,
+		holders: &DataHolder[map[string]popularityData]{
+			data: map[string]popularityData{},
+		},
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *popularityCollector) Collect(ch chan<- prometheus.Metric) {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+
+	committers := map[string]uint64{}
+	if c.commits != nil {
+		c.commits.recentCommitters.Lock()
+		for k, v := range c.commits.recentCommitters.data {
+			committers[k] = v
+		}
+		c.commits.recentCommitters.Unlock()
+	}
+	forks := map[string]uint64{}
+	if c.forks != nil {
+		c.forks.holders.Lock()
+		for k, v := range c.forks.holders.data {
+			forks[k] = v.Forks
+		}
+		c.forks.holders.Unlock()
+	}
+
+	committerWeight := popularityWeight(c.config.CommitterWeight, defaultCommitterWeight)
+	watcherWeight := popularityWeight(c.config.WatcherWeight, defaultWatcherWeight)
+	forkWeight := popularityWeight(c.config.ForkWeight, defaultForkWeight)
+
+	for uuid, v := range c.holders.data {
+		labels := []string{v.Workspace, v.Project, v.Repository}
+		ch <- prometheus.MustNewConstMetric(
+			popularityWatchersDesc,
+			prometheus.GaugeValue,
+			float64(v.Watchers),
+			labels...,
+		)
+		committerTotal, hasCommitters := committers[uuid]
+		if hasCommitters {
+			ch <- prometheus.MustNewConstMetric(
+				popularityCommittersDesc,
+				prometheus.GaugeValue,
+				float64(committerTotal),
+				labels...,
+			)
+		}
+		forkTotal, hasForks := forks[uuid]
+		if hasForks {
+			ch <- prometheus.MustNewConstMetric(
+				popularityForksDesc,
+				prometheus.GaugeValue,
+				float64(forkTotal),
+				labels...,
+			)
+		}
+
+		// a repo left out of either crawl has no comparable score
+		if !hasCommitters || !hasForks {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			popularityScoreDesc,
+			prometheus.GaugeValue,
+			float64(committerTotal)*committerWeight+float64(v.Watchers)*watcherWeight+float64(forkTotal)*forkWeight,
+			labels...,
+		)
+	}
+}
+
+// popularityWeight returns weight, or defaultWeight when it is not set.
+func popularityWeight(weight *float64, defaultWeight float64) float64 {
+	if weight == nil {
+		return defaultWeight
+	}
+	return *weight
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *popularityCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- popularityWatchersDesc
+	ch <- popularityForksDesc
+	ch <- popularityCommittersDesc
+	ch <- popularityScoreDesc
+}
+
+func (c *popularityCollector) dataHolders() map[string]holder {
+	return map[string]holder{"repositories": c.holders}
+}
+
+func (c *popularityCollector) repositoryCount() int {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+	return len(c.holders.data)
+}
+
+func (c *popularityCollector) Exec(ctx context.Context, instance *instance) error {
+	return collectRepositories(
+		c.feed,
+		keyPopularityCollector,
+		func(repo Repository) bool {
+			return includesRepository(c.config.IncludedRepository, repo)
+		},
+		c.holders,
+		"popularity",
+		func(repo Repository) (popularityData, error) {
+			return getPopularity(ctx, instance, repo)
+		},
+	)
+}
+
+// getPopularity counts the watchers of repo.
+func getPopularity(ctx context.Context, instance *instance, repo Repository) (popularityData, error) {
+	data := popularityData{
+		Workspace:  repo.Workspace.Slug,
+		Project:    repo.Project.Key,
+		Repository: repo.Slug,
+	}
+	pathParams := map[string]string{":workspace": repo.Workspace.Slug, ":repo_slug": repo.Slug}
+
+	err := getAllPages(
+		ctx,
+		instance,
+		watchersEndpoint,
+		pathParams,
+		map[string]string{"pagelen": "100"},
+		func(values []User) error {
+			data.Watchers += uint64(len(values))
+			return nil
+		},
+	)
+	return data, err
+}
@@ -0,0 +1,350 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/nandanurseptama/bitbucket-exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type projectData struct {
+	Workspace string    `json:"workspace"`
+	Key       string    `json:"key"`
+	Name      string    `json:"name"`
+	IsPrivate bool      `json:"is_private"`
+	CreatedOn time.Time `json:"created_on"`
+	UpdatedOn time.Time `json:"updated_on"`
+}
+
+// projectRollupKey identifies a project inside the data of other collectors.
+type projectRollupKey struct {
+	workspace string
+	project   string
+}
+
+// projectRollupData sums repository data of a project, the totals are nil
+// while the collector providing them is disabled or has no data yet.
+type projectRollupData struct {
+	repositories uint64
+	size         uint64
+	totalBranch  *uint64
+	totalTag     *uint64
+	totalCommit  *uint64
+}
+
+var (
+	projectLabels = []string{"workspace", "project"}
+
+	projectInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemProject,
+			"info",
+		),
+		"Information of this project",
+		append(projectLabels, "name", "is_private"),
+		nil,
+	)
+	projectCreatedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemProject,
+			"created_timestamp_seconds",
+		),
+		"Creation timestamp of this project",
+		projectLabels,
+		nil,
+	)
+	projectUpdatedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemProject,
+			"updated_timestamp_seconds",
+		),
+		"Last update timestamp of this project",
+		projectLabels,
+		nil,
+	)
+	projectRepositoriesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemProject,
+			"repositories",
+		),
+		"Total repo inside this project",
+		projectLabels,
+		nil,
+	)
+	projectSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemProject,
+			"size_bytes",
+		),
+		"Total size of repo inside this project",
+		projectLabels,
+		nil,
+	)
+	projectTotalBranchDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemProject,
+			"total_branch",
+		),
+		"Total branch of repo inside this project",
+		projectLabels,
+		nil,
+	)
+	projectTotalTagDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemProject,
+			"total_tag",
+		),
+		"Total tag of repo inside this project",
+		projectLabels,
+		nil,
+	)
+	projectTotalCommitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemProject,
+			"total_commit",
+		),
+		"Total commit of repo inside this project",
+		projectLabels,
+		nil,
+	)
+)
+
+type projectCollector struct {
+	config     *config.ProjectCollectorConfig
+	workspaces []string
+	// collectors the rollups are summed from, refs and commits are nil
+	// when disabled
+	repositories *repositoriesCollector
+	refs         *refsCollector
+	commits      *commitCollector
+	// keyed by project uuid
+	holders *DataHolder[map[string]projectData]
+}
+
+func NewProjectCollector(
+	config *config.ProjectCollectorConfig,
+	workspaces []string,
+	repositories *repositoriesCollector,
+	refs *refsCollector,
+	commits *commitCollector,
+) *projectCollector {
+	return &projectCollector{
+		config:       config,
+		workspaces:   workspaces,
+		repositories: repositories,
+		refs:         refs,
+		commits:      commits,
+		holders: &DataHolder[map[string]projectData]{
+			data: map[string]projectData{},
+		},
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *projectCollector) Collect(ch chan<- prometheus.Metric) {
+	if c.config.CollectInfo {
+		c.collectInfo(ch)
+	}
+	if c.config.CollectRollup {
+		c.collectRollup(ch)
+	}
+}
+
+func (c *projectCollector) collectInfo(ch chan<- prometheus.Metric) {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+
+	for _, v := range c.holders.data {
+		labels := []string{v.Workspace, v.Key}
+		ch <- prometheus.MustNewConstMetric(
+			projectInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			append(labels, v.Name, strconv.FormatBool(v.IsPrivate))...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			projectCreatedDesc,
+			prometheus.GaugeValue,
+			float64(v.CreatedOn.Unix()),
+			labels...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			projectUpdatedDesc,
+			prometheus.GaugeValue,
+			float64(v.UpdatedOn.Unix()),
+			labels...,
+		)
+	}
+}
+
+func (c *projectCollector) collectRollup(ch chan<- prometheus.Metric) {
+	rollups := c.rollups()
+	for key, v := range rollups {
+		labels := []string{key.workspace, key.project}
+		ch <- prometheus.MustNewConstMetric(
+			projectRepositoriesDesc,
+			prometheus.GaugeValue,
+			float64(v.repositories),
+			labels...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			projectSizeDesc,
+			prometheus.GaugeValue,
+			float64(v.size),
+			labels...,
+		)
+		for desc, total := range map[*prometheus.Desc]*uint64{
+			projectTotalBranchDesc: v.totalBranch,
+			projectTotalTagDesc:    v.totalTag,
+			projectTotalCommitDesc: v.totalCommit,
+		} {
+			if total == nil {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(
+				desc,
+				prometheus.GaugeValue,
+				float64(*total),
+				labels...,
+			)
+		}
+	}
+}
+
+// rollups sums the data of the other collectors per project.
+func (c *projectCollector) rollups() map[projectRollupKey]*projectRollupData {
+	rollups := map[projectRollupKey]*projectRollupData{}
+	get := func(workspace, project string) *projectRollupData {
+		key := projectRollupKey{workspace: workspace, project: project}
+		if rollups[key] == nil {
+			rollups[key] = &projectRollupData{}
+		}
+		return rollups[key]
+	}
+	add := func(total **uint64, value uint64) {
+		if *total == nil {
+			*total = new(uint64)
+		}
+		**total += value
+	}
+
+	c.repositories.holders.Lock()
+	for _, v := range c.repositories.holders.data {
+		rollup := get(v.Workspace.Slug, v.Project.Key)
+		rollup.repositories++
+		rollup.size += v.Size
+	}
+	c.repositories.holders.Unlock()
+
+	if c.refs != nil {
+		c.refs.totalBranchHolder.Lock()
+		for _, v := range c.refs.totalBranchHolder.data {
+			add(&get(v.Workspace, v.Project).totalBranch, v.Total)
+		}
+		c.refs.totalBranchHolder.Unlock()
+
+		c.refs.totalTagsHolder.Lock()
+		for _, v := range c.refs.totalTagsHolder.data {
+			add(&get(v.Workspace, v.Project).totalTag, v.Total)
+		}
+		c.refs.totalTagsHolder.Unlock()
+	}
+
+	if c.commits != nil {
+		c.commits.repoTotalCommit.Lock()
+		for _, v := range c.commits.repoTotalCommit.data {
+			add(&get(v.Workspace, v.Project).totalCommit, v.Total)
+		}
+		c.commits.repoTotalCommit.Unlock()
+	}
+
+	return rollups
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *projectCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- projectInfoDesc
+	ch <- projectCreatedDesc
+	ch <- projectUpdatedDesc
+	ch <- projectRepositoriesDesc
+	ch <- projectSizeDesc
+	ch <- projectTotalBranchDesc
+	ch <- projectTotalTagDesc
+	ch <- projectTotalCommitDesc
+}
+
+func (c *projectCollector) dataHolders() map[string]holder {
+	return map[string]holder{"projects": c.holders}
+}
+
+func (c *projectCollector) Exec(ctx context.Context, instance *instance) error {
+	// rollups are read from the other collectors at scrape time
+	if !c.config.CollectInfo {
+		return nil
+	}
+
+	for _, workspace := range c.workspaces {
+		projects := map[string]projectData{}
+		err := getAllPages(
+			ctx,
+			instance,
+			workspaceProjectsEndpoint,
+			map[string]string{":workspace": workspace},
+			map[string]string{"pagelen": "100"},
+			func(values []Project) error {
+				for _, v := range values {
+					projects[v.Uuid] = projectData{
+						Workspace: workspace,
+						Key:       v.Key,
+						Name:      v.Name,
+						IsPrivate: v.IsPrivate,
+						CreatedOn: v.CreatedOn,
+						UpdatedOn: v.UpdatedOn,
+					}
+				}
+				return nil
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		c.holders.Lock()
+		// forget deleted projects of this workspace
+		for uuid, v := range c.holders.data {
+			if v.Workspace == workspace {
+				delete(c.holders.data, uuid)
+			}
+		}
+		for uuid, v := range projects {
+			c.holders.data[uuid] = v
+		}
+		c.holders.touch()
+		c.holders.Unlock()
+	}
+
+	return nil
+}
@@ -0,0 +1,686 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/nandanurseptama/bitbucket-exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// default of lookback_days
+	defaultPullRequestLookbackDays = 30
+	// default of max_pull_requests
+	defaultMaxPullRequests = 100
+)
+
+var (
+	// upper bounds of review time, in seconds: 1h, 4h, 1d, 2d, 1w, 2w
+	reviewTimeBuckets = []float64{3600, 14400, 86400, 172800, 604800, 1209600}
+	// upper bounds of review rounds
+	reviewRoundsBuckets = []float64{0, 1, 2, 3, 5, 10}
+	// upper bounds of lines added or removed
+	diffLinesBuckets = []float64{10, 50, 100, 250, 500, 1000, 2500, 5000}
+	// upper bounds of files changed
+	diffFilesBuckets = []float64{1, 2, 5, 10, 20, 50, 100}
+
+	// size classes by lines added and removed, the last one has no upper bound
+	pullRequestSizeClasses = []struct {
+		name     string
+		maxLines uint64
+	}{
+		{"XS", 10},
+		{"S", 50},
+		{"M", 250},
+		{"L", 1000},
+		{"XL", 0},
+	}
+)
+
+// pullRequestSizeClass returns the size class of a pull request changing lines.
+func pullRequestSizeClass(lines uint64) string {
+	for _, class := range pullRequestSizeClasses {
+		if class.maxLines == 0 || lines < class.maxLines {
+			return class.name
+		}
+	}
+	return ""
+}
+
+type reviewerData struct {
+	Uuid     string `json:"uuid"`
+	Nickname string `json:"nickname"`
+	// open pull requests listing this reviewer, not yet reviewed by them
+	Awaiting uint64 `json:"awaiting"`
+	// time from creation to the first review of this reviewer
+	Response histogramData `json:"response"`
+}
+
+type pullRequestData struct {
+	Workspace  string `json:"workspace"`
+	Project    string `json:"project"`
+	Repository string `json:"repository"`
+	// histograms are observed across runs, once per pull request event
+
+	// of pull requests created inside the lookback
+	FirstReview   histogramData `json:"first_review"`
+	FirstApproval histogramData `json:"first_approval"`
+	ReviewRounds  histogramData `json:"review_rounds"`
+	// keyed by user uuid
+	Reviewers map[string]*reviewerData `json:"reviewers"`
+	// of pull requests merged inside the lookback
+	LinesAdded   histogramData `json:"lines_added"`
+	LinesRemoved histogramData `json:"lines_removed"`
+	FilesChanged histogramData `json:"files_changed"`
+	// keyed by size class
+	TimeToMerge map[string]histogramData `json:"time_to_merge"`
+	// reviews and merges up to this time are already observed
+	ObservedUntil time.Time `json:"observed_until"`
+}
+
+var (
+	pullRequestLabels         = []string{"workspace", "project", "repository"}
+	pullRequestReviewerLabels = []string{"workspace", "project", "repository", "reviewer"}
+	pullRequestTeamLabels     = []string{"workspace", "team"}
+
+	pullRequestFirstReviewDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPullRequest,
+			"time_to_first_review_seconds",
+		),
+		"Time from creation to the first approval, change request or comment of someone else than the author",
+		pullRequestLabels,
+		nil,
+	)
+	pullRequestFirstApprovalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPullRequest,
+			"time_to_first_approval_seconds",
+		),
+		"Time from creation to the first approval",
+		pullRequestLabels,
+		nil,
+	)
+	pullRequestReviewRoundsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPullRequest,
+			"review_rounds",
+		),
+		"Total change request followed by an update of the pull request, observed once merged",
+		pullRequestLabels,
+		nil,
+	)
+	pullRequestReviewerAwaitingDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPullRequest,
+			"reviewer_awaiting",
+		),
+		"Total open pull request waiting for a review of this reviewer",
+		pullRequestReviewerLabels,
+		nil,
+	)
+	pullRequestReviewerResponseDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPullRequest,
+			"reviewer_response_seconds",
+		),
+		"Time from creation to the first review of this reviewer",
+		pullRequestReviewerLabels,
+		nil,
+	)
+	pullRequestLinesAddedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPullRequest,
+			"lines_added",
+		),
+		"Lines added by merged pull requests",
+		pullRequestLabels,
+		nil,
+	)
+	pullRequestLinesRemovedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPullRequest,
+			"lines_removed",
+		),
+		"Lines removed by merged pull requests",
+		pullRequestLabels,
+		nil,
+	)
+	pullRequestFilesChangedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPullRequest,
+			"files_changed",
+		),
+		"Files changed by merged pull requests",
+		pullRequestLabels,
+		nil,
+	)
+	pullRequestTimeToMergeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPullRequest,
+			"time_to_merge_seconds",
+		),
+		"Time from creation to merge by size class, XS under 10 lines changed, S 50, M 250, L 1000, XL above",
+		append(pullRequestLabels, "size"),
+		nil,
+	)
+	pullRequestTeamAwaitingDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPullRequest,
+			"team_awaiting",
+		),
+		"Total open pull request waiting for a review of a member of this team",
+		pullRequestTeamLabels,
+		nil,
+	)
+	pullRequestTeamResponseDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemPullRequest,
+			"team_response_seconds",
+		),
+		"Time from creation to the first review of a member of this team",
+		pullRequestTeamLabels,
+		nil,
+	)
+)
+
+type pullRequestCollector struct {
+	config *config.PullRequestCollectorConfig
+	feed   *repositoryFeed
+	// reviewers are aggregated per team, nil when no team is defined
+	teams *teamCollector
+	// keyed by repository uuid
+	holders *DataHolder[map[string]pullRequestData]
+}
+
+func NewPullRequestCollector(
+	config *config.PullRequestCollectorConfig,
+	feed *repositoryFeed,
+	teams *teamCollector,
+) *pullRequestCollector {
+	return &pullRequestCollector{
+		config: config,
+		feed:   feed,
+		teams:  teams,
+		holders: &DataHolder[map[string]pullRequestData]{
+			data: map[string]pullRequestData{},
+		},
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *pullRequestCollector) Collect(ch chan<- prometheus.Metric) {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+
+	type teamKey struct {
+		workspace string
+		team      string
+	}
+	teamAwaiting := map[teamKey]uint64{}
+	teamResponse := map[teamKey]*histogramData{}
+
+	for _, v := range c.holders.data {
+		labels := []string{v.Workspace, v.Project, v.Repository}
+		ch <- v.FirstReview.metric(pullRequestFirstReviewDesc, reviewTimeBuckets, labels...)
+		ch <- v.FirstApproval.metric(pullRequestFirstApprovalDesc, reviewTimeBuckets, labels...)
+		ch <- v.ReviewRounds.metric(pullRequestReviewRoundsDesc, reviewRoundsBuckets, labels...)
+		if c.config.CollectDiffstat {
+			ch <- v.LinesAdded.metric(pullRequestLinesAddedDesc, diffLinesBuckets, labels...)
+			ch <- v.LinesRemoved.metric(pullRequestLinesRemovedDesc, diffLinesBuckets, labels...)
+			ch <- v.FilesChanged.metric(pullRequestFilesChangedDesc, diffFilesBuckets, labels...)
+			for _, class := range pullRequestSizeClasses {
+				timeToMerge, ok := v.TimeToMerge[class.name]
+				if !ok {
+					timeToMerge = newHistogramData(reviewTimeBuckets)
+				}
+				ch <- timeToMerge.metric(pullRequestTimeToMergeDesc, reviewTimeBuckets, append(labels, class.name)...)
+			}
+		}
+
+		for _, reviewer := range v.Reviewers {
+			if !c.teams.dropUserSeries() {
+				reviewerLabels := append(labels, reviewer.Nickname)
+				ch <- prometheus.MustNewConstMetric(
+					pullRequestReviewerAwaitingDesc,
+					prometheus.GaugeValue,
+					float64(reviewer.Awaiting),
+					reviewerLabels...,
+				)
+				ch <- reviewer.Response.metric(pullRequestReviewerResponseDesc, reviewTimeBuckets, reviewerLabels...)
+			}
+
+			user := User{Uuid: reviewer.Uuid, Nickname: reviewer.Nickname}
+			for _, team := range c.teams.teamsOf(v.Workspace, user, "") {
+				key := teamKey{workspace: v.Workspace, team: team}
+				teamAwaiting[key] += reviewer.Awaiting
+				if teamResponse[key] == nil {
+					h := newHistogramData(reviewTimeBuckets)
+					teamResponse[key] = &h
+				}
+				teamResponse[key].merge(reviewer.Response)
+			}
+		}
+	}
+
+	for key, awaiting := range teamAwaiting {
+		ch <- prometheus.MustNewConstMetric(
+			pullRequestTeamAwaitingDesc,
+			prometheus.GaugeValue,
+			float64(awaiting),
+			key.workspace, key.team,
+		)
+		ch <- teamResponse[key].metric(pullRequestTeamResponseDesc, reviewTimeBuckets, key.workspace, key.team)
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *pullRequestCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pullRequestFirstReviewDesc
+	ch <- pullRequestFirstApprovalDesc
+	ch <- pullRequestReviewRoundsDesc
+	ch <- pullRequestReviewerAwaitingDesc
+	ch <- pullRequestReviewerResponseDesc
+	ch <- pullRequestLinesAddedDesc
+	ch <- pullRequestLinesRemovedDesc
+	ch <- pullRequestFilesChangedDesc
+	ch <- pullRequestTimeToMergeDesc
+	ch <- pullRequestTeamAwaitingDesc
+	ch <- pullRequestTeamResponseDesc
+}
+
+func (c *pullRequestCollector) dataHolders() map[string]holder {
+	return map[string]holder{"repositories": c.holders}
+}
+
+func (c *pullRequestCollector) repositoryCount() int {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+	return len(c.holders.data)
+}
+
+func (c *pullRequestCollector) Exec(ctx context.Context, instance *instance) error {
+	return collectRepositories(
+		c.feed,
+		keyPullRequestCollector,
+		func(repo Repository) bool {
+			return includesRepository(c.config.IncludedRepository, repo)
+		},
+		c.holders,
+		"pull requests",
+		func(repo Repository) (pullRequestData, error) {
+			return c.getPullRequests(ctx, instance, repo)
+		},
+	)
+}
+
+func (c *pullRequestCollector) getPullRequests(
+	ctx context.Context,
+	instance *instance,
+	repo Repository,
+) (pullRequestData, error) {
+	lookbackDays := c.config.LookbackDays
+	if lookbackDays <= 0 {
+		lookbackDays = defaultPullRequestLookbackDays
+	}
+	now := time.Now()
+	since := now.AddDate(0, 0, -lookbackDays)
+
+	data := pullRequestData{
+		Workspace:     repo.Workspace.Slug,
+		Project:       repo.Project.Key,
+		Repository:    repo.Slug,
+		FirstReview:   newHistogramData(reviewTimeBuckets),
+		FirstApproval: newHistogramData(reviewTimeBuckets),
+		ReviewRounds:  newHistogramData(reviewRoundsBuckets),
+		Reviewers:     map[string]*reviewerData{},
+		LinesAdded:    newHistogramData(diffLinesBuckets),
+		LinesRemoved:  newHistogramData(diffLinesBuckets),
+		FilesChanged:  newHistogramData(diffFilesBuckets),
+		TimeToMerge:   map[string]histogramData{},
+	}
+	reviewer := func(user User) *reviewerData {
+		if data.Reviewers[user.Uuid] == nil {
+			data.Reviewers[user.Uuid] = &reviewerData{
+				Uuid:     user.Uuid,
+				Nickname: user.Nickname,
+				Response: newHistogramData(reviewTimeBuckets),
+			}
+		}
+		return data.Reviewers[user.Uuid]
+	}
+
+	// histograms are cumulative, only events after the previous run are
+	// observed
+	var observedUntil time.Time
+	c.holders.Lock()
+	if previous, ok := c.holders.data[repo.Uuid]; ok {
+		observedUntil = previous.ObservedUntil
+		data.FirstReview = previous.FirstReview.clone()
+		data.FirstApproval = previous.FirstApproval.clone()
+		data.ReviewRounds = previous.ReviewRounds.clone()
+		data.LinesAdded = previous.LinesAdded.clone()
+		data.LinesRemoved = previous.LinesRemoved.clone()
+		data.FilesChanged = previous.FilesChanged.clone()
+		for class, timeToMerge := range previous.TimeToMerge {
+			data.TimeToMerge[class] = timeToMerge.clone()
+		}
+		for uuid, v := range previous.Reviewers {
+			data.Reviewers[uuid] = &reviewerData{
+				Uuid:     v.Uuid,
+				Nickname: v.Nickname,
+				Response: v.Response.clone(),
+			}
+		}
+	}
+	c.holders.Unlock()
+	observe := func(date time.Time) bool {
+		return date.After(observedUntil) && !date.After(now)
+	}
+
+	open, err := c.listPullRequests(ctx, instance, repo, "OPEN", time.Time{})
+	if err != nil {
+		return data, err
+	}
+	merged, err := c.listPullRequests(ctx, instance, repo, "MERGED", since)
+	if err != nil {
+		return data, err
+	}
+
+	for _, pr := range open {
+		for _, user := range pr.Reviewers {
+			if !reviewedBy(pr, user) {
+				reviewer(user).Awaiting++
+			}
+		}
+	}
+
+	for _, pr := range append(open, merged...) {
+		// turnaround of pull requests created inside the lookback, size of
+		// pull requests merged inside it
+		createdInside := !pr.CreatedOn.Before(since)
+		collectSize := c.config.CollectDiffstat && pr.State == "MERGED"
+		if !createdInside && !collectSize {
+			continue
+		}
+		// every event of a pull request not updated since the previous run
+		// is already observed, Awaiting only needs the list above
+		if !pr.UpdatedOn.After(observedUntil) {
+			continue
+		}
+
+		activities, err := c.getActivities(ctx, instance, repo, pr)
+		if err != nil {
+			return data, err
+		}
+		review := reviewPullRequest(pr, activities)
+
+		// the last update when no merge activity is listed
+		mergedOn := review.merged
+		if mergedOn.IsZero() && pr.State == "MERGED" {
+			mergedOn = pr.UpdatedOn
+		}
+
+		if collectSize && observe(mergedOn) {
+			if err := c.observeSize(ctx, instance, repo, pr, mergedOn, &data); err != nil {
+				return data, err
+			}
+		}
+		if !createdInside {
+			continue
+		}
+
+		if !review.firstReview.IsZero() && observe(review.firstReview) {
+			data.FirstReview.observe(reviewTimeBuckets, review.firstReview.Sub(pr.CreatedOn).Seconds())
+		}
+		if !review.firstApproval.IsZero() && observe(review.firstApproval) {
+			data.FirstApproval.observe(reviewTimeBuckets, review.firstApproval.Sub(pr.CreatedOn).Seconds())
+		}
+		if !mergedOn.IsZero() && observe(mergedOn) {
+			data.ReviewRounds.observe(reviewRoundsBuckets, float64(review.rounds))
+		}
+		for _, r := range review.reviewers {
+			if observe(r.date) {
+				reviewer(r.user).Response.observe(reviewTimeBuckets, r.date.Sub(pr.CreatedOn).Seconds())
+			}
+		}
+	}
+
+	data.ObservedUntil = now
+	return data, nil
+}
+
+// observeSize adds the lines and files changed by the merged pr to data.
+func (c *pullRequestCollector) observeSize(
+	ctx context.Context,
+	instance *instance,
+	repo Repository,
+	pr PullRequest,
+	mergedOn time.Time,
+	data *pullRequestData,
+) error {
+	pathParams := map[string]string{
+		":workspace":    repo.Workspace.Slug,
+		":repo_slug":    repo.Slug,
+		":pull_request": strconv.FormatUint(pr.Id, 10),
+	}
+
+	var added, removed, files uint64
+	err := getAllPages(
+		ctx,
+		instance,
+		pullRequestDiffstatEndpoint,
+		pathParams,
+		map[string]string{"pagelen": "500"},
+		func(values []Diffstat) error {
+			for _, v := range values {
+				added += v.LinesAdded
+				removed += v.LinesRemoved
+				files++
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	data.LinesAdded.observe(diffLinesBuckets, float64(added))
+	data.LinesRemoved.observe(diffLinesBuckets, float64(removed))
+	data.FilesChanged.observe(diffFilesBuckets, float64(files))
+
+	class := pullRequestSizeClass(added + removed)
+	timeToMerge, ok := data.TimeToMerge[class]
+	if !ok {
+		timeToMerge = newHistogramData(reviewTimeBuckets)
+	}
+	timeToMerge.observe(reviewTimeBuckets, mergedOn.Sub(pr.CreatedOn).Seconds())
+	data.TimeToMerge[class] = timeToMerge
+	return nil
+}
+
+// listPullRequests returns the most recently updated pull requests in
+// state, updated after since unless zero.
+func (c *pullRequestCollector) listPullRequests(
+	ctx context.Context,
+	instance *instance,
+	repo Repository,
+	state string,
+	since time.Time,
+) ([]PullRequest, error) {
+	maxPullRequests := c.config.MaxPullRequests
+	if maxPullRequests <= 0 {
+		maxPullRequests = defaultMaxPullRequests
+	}
+
+	params := map[string]string{
+		"pagelen": "50",
+		"state":   state,
+		"sort":    "-updated_on",
+		"fields":  "+values.reviewers,+values.participants",
+	}
+	if !since.IsZero() {
+		params["q"] = "updated_on > " + since.UTC().Format(time.RFC3339)
+	}
+
+	var pullRequests []PullRequest
+	err := getAllPages(
+		ctx,
+		instance,
+		pullRequestsEndpoint,
+		map[string]string{":workspace": repo.Workspace.Slug, ":repo_slug": repo.Slug},
+		params,
+		func(values []PullRequest) error {
+			for _, v := range values {
+				if len(pullRequests) >= maxPullRequests {
+					return errLastPage
+				}
+				pullRequests = append(pullRequests, v)
+			}
+			return nil
+		},
+	)
+	return pullRequests, err
+}
+
+func (c *pullRequestCollector) getActivities(
+	ctx context.Context,
+	instance *instance,
+	repo Repository,
+	pr PullRequest,
+) ([]PullRequestActivity, error) {
+	pathParams := map[string]string{
+		":workspace":    repo.Workspace.Slug,
+		":repo_slug":    repo.Slug,
+		":pull_request": strconv.FormatUint(pr.Id, 10),
+	}
+
+	var activities []PullRequestActivity
+	err := getAllPages(
+		ctx,
+		instance,
+		pullRequestActivityEndpoint,
+		pathParams,
+		map[string]string{"pagelen": "50"},
+		func(values []PullRequestActivity) error {
+			activities = append(activities, values...)
+			return nil
+		},
+	)
+	return activities, err
+}
+
+// reviewedBy reports whether user approved or requested changes on pr.
+func reviewedBy(pr PullRequest, user User) bool {
+	for _, participant := range pr.Participants {
+		if participant.User.Uuid == user.Uuid && participant.State != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// reviewerReview is the first review of a reviewer.
+type reviewerReview struct {
+	user User
+	date time.Time
+}
+
+type pullRequestReview struct {
+	// zero when it did not happen
+	firstReview   time.Time
+	firstApproval time.Time
+	merged        time.Time
+	rounds        int
+	reviewers     []reviewerReview
+}
+
+// reviewPullRequest walks the activities of pr from the oldest one.
+func reviewPullRequest(pr PullRequest, activities []PullRequestActivity) pullRequestReview {
+	type event struct {
+		date   time.Time
+		user   User
+		kind   string
+		state  string
+		review bool
+	}
+
+	var events []event
+	for _, v := range activities {
+		switch {
+		case v.Update != nil:
+			events = append(events, event{date: v.Update.Date, user: v.Update.Author, kind: "update", state: v.Update.State})
+		case v.Approval != nil:
+			events = append(events, event{date: v.Approval.Date, user: v.Approval.User, kind: "approval", review: true})
+		case v.ChangesRequested != nil:
+			events = append(events, event{date: v.ChangesRequested.Date, user: v.ChangesRequested.User, kind: "changes_requested", review: true})
+		case v.Comment != nil:
+			events = append(events, event{date: v.Comment.CreatedOn, user: v.Comment.User, kind: "comment", review: true})
+		}
+	}
+	// the API lists the newest first
+	slices.SortStableFunc(events, func(a, b event) int {
+		return a.date.Compare(b.date)
+	})
+
+	var review pullRequestReview
+	reviewed := map[string]bool{}
+	changesRequested := false
+	for _, e := range events {
+		if e.kind == "update" {
+			if e.state == "MERGED" && review.merged.IsZero() {
+				review.merged = e.date
+			}
+			if changesRequested {
+				review.rounds++
+				changesRequested = false
+			}
+			continue
+		}
+		if e.kind == "changes_requested" {
+			changesRequested = true
+		}
+		if e.kind == "approval" && review.firstApproval.IsZero() {
+			review.firstApproval = e.date
+		}
+
+		if !e.review || e.user.Uuid == pr.Author.Uuid {
+			continue
+		}
+		if review.firstReview.IsZero() {
+			review.firstReview = e.date
+		}
+		if !reviewed[e.user.Uuid] {
+			reviewed[e.user.Uuid] = true
+			review.reviewers = append(review.reviewers, reviewerReview{user: e.user, date: e.date})
+		}
+	}
+	return review
+}
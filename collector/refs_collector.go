@@ -18,7 +18,6 @@ import (
 	"errors"
 	"fmt"
 	"slices"
-	"strings"
 	"sync"
 
 	"github.com/nandanurseptama/bitbucket-exporter/config"
@@ -26,10 +25,10 @@ import (
 )
 
 type refsData struct {
-	workspace  string
-	project    string
-	repository string
-	total      uint64
+	Workspace  string `json:"workspace"`
+	Project    string `json:"project"`
+	Repository string `json:"repository"`
+	Total      uint64 `json:"total"`
 }
 
 var (
@@ -57,24 +56,23 @@ var (
 )
 
 type refsCollector struct {
-	config                    *config.RefsCollectorConfig
-	refsRepositoryDataChannel <-chan Repository
-	// channel to passing refs data
-	//refsBranchDataChannel chan<- Refs
+	config *config.RefsCollectorConfig
+	feed   *repositoryFeed
 
-	totalTagsHolder   DataHolder[[]refsData]
-	totalBranchHolder DataHolder[[]refsData]
+	// refs data keyed by repository uuid
+	totalTagsHolder   DataHolder[map[string]refsData]
+	totalBranchHolder DataHolder[map[string]refsData]
 }
 
-func NewRefsCollector(config *config.RefsCollectorConfig, refsRepositoryDataChannel <-chan Repository) *refsCollector {
+func NewRefsCollector(config *config.RefsCollectorConfig, feed *repositoryFeed) *refsCollector {
 	return &refsCollector{
-		config:                    config,
-		refsRepositoryDataChannel: refsRepositoryDataChannel,
-		totalTagsHolder: DataHolder[[]refsData]{
-			data: []refsData{},
+		config: config,
+		feed:   feed,
+		totalTagsHolder: DataHolder[map[string]refsData]{
+			data: map[string]refsData{},
 		},
-		totalBranchHolder: DataHolder[[]refsData]{
-			data: []refsData{},
+		totalBranchHolder: DataHolder[map[string]refsData]{
+			data: map[string]refsData{},
 		},
 	}
 }
@@ -89,11 +87,11 @@ func (c *refsCollector) Collect(ch chan<- prometheus.Metric) {
 		defer c.totalBranchHolder.Unlock()
 		defer wg.Done()
 		for _, v := range c.totalBranchHolder.data {
-			labels := []string{v.workspace, v.project, v.repository}
+			labels := []string{v.Workspace, v.Project, v.Repository}
 			ch <- prometheus.MustNewConstMetric(
 				repositoryRefsTotalBranch,
 				prometheus.GaugeValue,
-				float64(v.total),
+				float64(v.Total),
 				labels...,
 			)
 		}
@@ -105,11 +103,11 @@ func (c *refsCollector) Collect(ch chan<- prometheus.Metric) {
 		defer c.totalTagsHolder.Unlock()
 		defer wg.Done()
 		for _, v := range c.totalTagsHolder.data {
-			labels := []string{v.workspace, v.project, v.repository}
+			labels := []string{v.Workspace, v.Project, v.Repository}
 			ch <- prometheus.MustNewConstMetric(
 				repositoryRefsTotalTag,
 				prometheus.GaugeValue,
-				float64(v.total),
+				float64(v.Total),
 				labels...,
 			)
 		}
@@ -123,15 +121,40 @@ func (p *refsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- repositoryRefsTotalTag
 	ch <- repositoryRefsTotalBranch
 }
+
+func (c *refsCollector) dataHolders() map[string]holder {
+	return map[string]holder{
+		"total_tags":   &c.totalTagsHolder,
+		"total_branch": &c.totalBranchHolder,
+	}
+}
 func (c *refsCollector) Exec(ctx context.Context, instance *instance) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	seen := map[string]bool{}
 
-	for repo := range c.refsRepositoryDataChannel {
-		if c.config == nil {
-			return errors.New("refs_collector : config nil")
-		}
+	collect := func(repo Repository) {
+		seen[repo.Uuid] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := c.collectRefs(ctx, repo, instance)
+			if skippable(err) {
+				c.feed.logger.Info("skipping repository", "collector", keyRefsCollector, "repository", repo.FullName, "err", err)
+				return
+			}
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("error collecting refs of %s: %w", repo.FullName, err))
+				mu.Unlock()
+			}
+		}()
+	}
 
-		if len(c.config.IncludedRepository) < 1 {
-			return nil
+	for repo := range c.feed.subscribe(keyRefsCollector) {
+		if c.config == nil || len(c.config.IncludedRepository) < 1 {
+			continue
 		}
 
 		if !c.config.CollectTotalBranch && !c.config.CollectTotalTag {
@@ -140,7 +163,7 @@ func (c *refsCollector) Exec(ctx context.Context, instance *instance) error {
 
 		first := c.config.IncludedRepository[0]
 		if first == "*" && len(c.config.IncludedRepository) == 1 {
-			go c.collectRefs(ctx, repo, instance)
+			collect(repo)
 			continue
 		}
 		i := slices.Index(
@@ -152,28 +175,49 @@ func (c *refsCollector) Exec(ctx context.Context, instance *instance) error {
 			continue
 		}
 
-		go c.collectRefs(ctx, repo, instance)
+		collect(repo)
+	}
+
+	// wait until refs of every repository collected
+	wg.Wait()
+
+	if c.feed.completed() {
+		pruneRepositories(&c.totalTagsHolder, seen)
+		pruneRepositories(&c.totalBranchHolder, seen)
 	}
+	return errors.Join(errs...)
+}
 
-	return nil
+func (c *refsCollector) repositoryCount() int {
+	c.totalBranchHolder.Lock()
+	defer c.totalBranchHolder.Unlock()
+	c.totalTagsHolder.Lock()
+	defer c.totalTagsHolder.Unlock()
+	return max(len(c.totalBranchHolder.data), len(c.totalTagsHolder.data))
 }
 
-func (c *refsCollector) collectRefs(ctx context.Context, repo Repository, instance *instance) {
+func (c *refsCollector) collectRefs(ctx context.Context, repo Repository, instance *instance) error {
 	var wg sync.WaitGroup
+	var tagErr, branchErr error
 
 	if c.config.CollectTotalTag {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			totalTag, _ := c.getTags(ctx, repo, instance)
+			totalTag, err := c.getTags(ctx, repo, instance)
+			if err != nil {
+				tagErr = err
+				return
+			}
 
 			c.totalTagsHolder.Lock()
-			c.totalTagsHolder.data = append(c.totalTagsHolder.data, refsData{
-				workspace:  repo.Workspace.Slug,
-				project:    repo.Project.Key,
-				repository: repo.Slug,
-				total:      totalTag,
-			})
+			c.totalTagsHolder.data[repo.Uuid] = refsData{
+				Workspace:  repo.Workspace.Slug,
+				Project:    repo.Project.Key,
+				Repository: repo.Slug,
+				Total:      totalTag,
+			}
+			c.totalTagsHolder.touch()
 			c.totalTagsHolder.Unlock()
 		}()
 	}
@@ -182,20 +226,26 @@ func (c *refsCollector) collectRefs(ctx context.Context, repo Repository, instan
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			totalBranch, _ := c.getBranches(ctx, repo, instance)
+			totalBranch, err := c.getBranches(ctx, repo, instance)
+			if err != nil {
+				branchErr = err
+				return
+			}
 			c.totalBranchHolder.Lock()
-			c.totalBranchHolder.data = append(c.totalBranchHolder.data, refsData{
-				workspace:  repo.Workspace.Slug,
-				project:    repo.Project.Key,
-				repository: repo.Slug,
-				total:      totalBranch,
-			})
+			c.totalBranchHolder.data[repo.Uuid] = refsData{
+				Workspace:  repo.Workspace.Slug,
+				Project:    repo.Project.Key,
+				Repository: repo.Slug,
+				Total:      totalBranch,
+			}
+			c.totalBranchHolder.touch()
 			c.totalBranchHolder.Unlock()
 		}()
 	}
 	if c.config.CollectTotalBranch || c.config.CollectTotalTag {
 		wg.Wait()
 	}
+	return errors.Join(tagErr, branchErr)
 }
 
 func (c *refsCollector) getTags(ctx context.Context, repo Repository, instance *instance) (uint64, error) {
@@ -210,12 +260,11 @@ func (c *refsCollector) getRefs(
 	workspace, repo, refType string,
 	instance *instance,
 ) (uint64, error) {
-	endpoint := strings.ReplaceAll(refsRepositoryEndpoint, ":workspace", workspace)
-	endpoint = strings.ReplaceAll(endpoint, ":repo_slug", repo)
+	pathParams := map[string]string{":workspace": workspace, ":repo_slug": repo}
 	params := map[string]string{"q": fmt.Sprintf("type=\"%s\"", refType)}
 	var respBody PaginationResponse[Refs]
 
-	err := instance.GET(ctx, endpoint, params, &respBody)
+	err := instance.GET(ctx, refsRepositoryEndpoint, pathParams, params, &respBody)
 
 	if err != nil {
 		return 0, err
@@ -15,7 +15,6 @@ package collector
 
 import (
 	"context"
-	"fmt"
 	"net/url"
 	"strconv"
 	"time"
@@ -24,6 +23,21 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+const (
+	// Bitbucket warns about repositories above 1 GB
+	repoSizeWarningLimit = 1 << 30
+	// and blocks pushes to repositories above 4 GB
+	repoSizeHardLimit = 4 << 30
+)
+
+// size of a repository at its last refresh
+type sizeGrowthData struct {
+	Size        uint64    `json:"size"`
+	RefreshedAt time.Time `json:"refreshed_at"`
+	// bytes per second between the two last refreshes
+	Rate float64 `json:"rate"`
+}
+
 var repoLabels = []string{
 	"workspace",
 	"project",
@@ -33,6 +47,11 @@ var repoLabels = []string{
 	"has_wiki",
 	"is_private",
 }
+
+// labels of the repository metrics other than info ones, without the
+// attributes of the repo so their series survive a change of them
+var repoKeyLabels = []string{"workspace", "project", "name"}
+
 var (
 	repoInfoDesc = prometheus.NewDesc(
 		prometheus.BuildFQName(
@@ -70,29 +89,74 @@ var (
 			subSystemRepositories,
 			"size",
 		),
-		"Size of repo in KB",
+		"Size of repo in bytes",
 		repoLabels,
 		nil,
 	)
+	repoSizeGrowthDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemRepositories,
+			"size_growth_bytes_per_second",
+		),
+		"Growth of the size of repo between the two last refreshes, labelled by workspace, project and name only",
+		repoKeyLabels,
+		nil,
+	)
+	repoSizeOverLimitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemRepositories,
+			"size_over_limit",
+		),
+		"Whether the size of repo is above the Bitbucket limit, 1 GB warning or 4 GB hard limit blocking pushes, labelled by workspace, project and name only",
+		append(repoKeyLabels, "limit"),
+		nil,
+	)
+	languageRepositoriesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemRepositories,
+			"language_total",
+		),
+		"Total repo of this language inside the project",
+		[]string{"workspace", "project", "language"},
+		nil,
+	)
+	languageSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemRepositories,
+			"language_size_bytes",
+		),
+		"Total size of repo of this language inside the project",
+		[]string{"workspace", "project", "language"},
+		nil,
+	)
 )
 
 type repositoriesCollector struct {
-	workspaces                []string
-	holders                   *DataHolder[[]Repository]
-	repositoryRefsDataChannel chan<- Repository
-	commitRepoDataChannel     chan<- Repository
+	workspaces []string
+	holders    *DataHolder[map[string]Repository]
+	// keyed by repository uuid
+	growth *DataHolder[map[string]sizeGrowthData]
+	// feed to the collectors working per repository
+	feed *repositoryFeed
 }
 
 func NewRepositoriesCollector(
 	workspaces []string,
-	repositoryRefsDataChannel chan<- Repository,
-	commitRepoDataChannel chan<- Repository,
+	feed *repositoryFeed,
 ) *repositoriesCollector {
 	return &repositoriesCollector{
-		workspaces:                workspaces,
-		holders:                   &DataHolder[[]Repository]{},
-		repositoryRefsDataChannel: repositoryRefsDataChannel,
-		commitRepoDataChannel:     commitRepoDataChannel,
+		workspaces: workspaces,
+		holders: &DataHolder[map[string]Repository]{
+			data: map[string]Repository{},
+		},
+		growth: &DataHolder[map[string]sizeGrowthData]{
+			data: map[string]sizeGrowthData{},
+		},
+		feed: feed,
 	}
 }
 
@@ -100,8 +164,18 @@ func NewRepositoriesCollector(
 func (c *repositoriesCollector) Collect(ch chan<- prometheus.Metric) {
 	c.holders.Lock()
 	defer c.holders.Unlock()
+	c.growth.Lock()
+	defer c.growth.Unlock()
+
+	type languageKey struct {
+		workspace string
+		project   string
+		language  string
+	}
+	languageTotal := map[languageKey]uint64{}
+	languageSize := map[languageKey]uint64{}
 
-	for _, v := range c.holders.data {
+	for uuid, v := range c.holders.data {
 		labels := []string{
 			v.Workspace.Slug,
 			v.Project.Key,
@@ -135,6 +209,47 @@ func (c *repositoriesCollector) Collect(ch chan<- prometheus.Metric) {
 			float64(v.Size),
 			labels...,
 		)
+
+		keyLabels := []string{v.Workspace.Slug, v.Project.Key, v.Slug}
+		if growth, ok := c.growth.data[uuid]; ok {
+			ch <- prometheus.MustNewConstMetric(
+				repoSizeGrowthDesc,
+				prometheus.GaugeValue,
+				growth.Rate,
+				keyLabels...,
+			)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			repoSizeOverLimitDesc,
+			prometheus.GaugeValue,
+			helpers.BoolToFloat(v.Size > repoSizeWarningLimit),
+			append(keyLabels, "warning")...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			repoSizeOverLimitDesc,
+			prometheus.GaugeValue,
+			helpers.BoolToFloat(v.Size > repoSizeHardLimit),
+			append(keyLabels, "hard")...,
+		)
+
+		key := languageKey{workspace: v.Workspace.Slug, project: v.Project.Key, language: v.Language}
+		languageTotal[key]++
+		languageSize[key] += v.Size
+	}
+
+	for key, total := range languageTotal {
+		ch <- prometheus.MustNewConstMetric(
+			languageRepositoriesDesc,
+			prometheus.GaugeValue,
+			float64(total),
+			key.workspace, key.project, key.language,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			languageSizeDesc,
+			prometheus.GaugeValue,
+			float64(languageSize[key]),
+			key.workspace, key.project, key.language,
+		)
 	}
 }
 
@@ -144,71 +259,151 @@ func (p *repositoriesCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- repoCreatedOnDesc
 	ch <- repoUpdatedOnDesc
 	ch <- repoSizeDesc
+	ch <- repoSizeGrowthDesc
+	ch <- repoSizeOverLimitDesc
+	ch <- languageRepositoriesDesc
+	ch <- languageSizeDesc
+}
 
+func (c *repositoriesCollector) dataHolders() map[string]holder {
+	return map[string]holder{"repositories": c.holders, "size_growth": c.growth}
+}
+
+func (c *repositoriesCollector) repositoryCount() int {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+	return len(c.holders.data)
 }
 
 func (c *repositoriesCollector) Exec(
 	ctx context.Context,
 	instance *instance,
-) error {
-	page := 1
-	for _, workspace := range c.workspaces {
-		for {
-			var params = map[string]string{"role": "member", "sort": "-created_on", "page": strconv.Itoa(page)}
+) (err error) {
+	// let the collectors working per repository finish their run, they
+	// only forget the repositories not published by a complete run
+	defer func() { c.feed.close(err == nil) }()
 
-			var respBody PaginationResponse[Repository]
-			err := instance.GET(ctx, fmt.Sprintf("%s/%s", repositoriesEndpoint, workspace), params, &respBody)
+	// uuid of every repository fetched
+	seen := map[string]bool{}
+	for _, workspace := range c.workspaces {
+		if err := c.collectWorkspace(ctx, instance, workspace, seen); err != nil {
+			return err
+		}
+	}
 
-			if err != nil {
-				return err
-			}
+	// forget deleted and renamed repositories
+	pruneRepositories(c.holders, seen)
+	pruneRepositories(c.growth, seen)
+	return nil
+}
 
-			values := respBody.Values
-			// add to data holder
-			if len(values) > 0 {
-				c.holders.Lock()
-				c.holders.data = append(c.holders.data, values...)
-				c.holders.Unlock()
-			}
+func (c *repositoriesCollector) collectWorkspace(
+	ctx context.Context,
+	instance *instance,
+	workspace string,
+	seen map[string]bool,
+) error {
+	page := 1
+	for {
+		var params = map[string]string{"role": "member", "sort": "-created_on", "page": strconv.Itoa(page)}
 
-			fmt.Println("passing to refs collector")
-			// send to refs data channel
-			for _, v := range values {
-				c.repositoryRefsDataChannel <- v
-				c.commitRepoDataChannel <- v
-			}
-			fmt.Println("passing to other done")
+		var respBody PaginationResponse[Repository]
+		err := instance.GET(
+			ctx,
+			repositoriesEndpoint,
+			map[string]string{":workspace": workspace},
+			params,
+			&respBody,
+		)
 
-			if respBody.Next == nil {
-				return nil
-			}
+		if err != nil {
+			return err
+		}
 
-			if *respBody.Next == "" {
-				return nil
+		values := respBody.Values
+		// add to data holder
+		if len(values) > 0 {
+			c.holders.Lock()
+			for _, v := range values {
+				c.holders.data[v.Uuid] = v
+				seen[v.Uuid] = true
 			}
+			c.holders.touch()
+			c.holders.Unlock()
+			c.observeGrowth(values)
+		}
 
-			url, err := url.Parse(*respBody.Next)
-			if err != nil {
+		// send to the collectors working per repository
+		for _, v := range values {
+			if err := c.feed.publish(ctx, v); err != nil {
 				return err
 			}
+		}
 
-			nextPage := url.Query().Get("page")
-			if nextPage == "" {
-				return nil
-			}
+		if respBody.Next == nil {
+			return nil
+		}
 
-			nextPageInt, err := strconv.Atoi(nextPage)
+		if *respBody.Next == "" {
+			return nil
+		}
 
-			if err != nil {
-				return err
-			}
+		url, err := url.Parse(*respBody.Next)
+		if err != nil {
+			return err
+		}
+
+		nextPage := url.Query().Get("page")
+		if nextPage == "" {
+			return nil
+		}
 
-			fmt.Println("nextPage :", nextPage)
-			page = nextPageInt
+		nextPageInt, err := strconv.Atoi(nextPage)
 
-			time.Sleep(1 * time.Second)
+		if err != nil {
+			return err
 		}
+
+		instance.logger.Debug("fetching next repositories page", "workspace", workspace, "page", nextPageInt)
+		page = nextPageInt
+
+		time.Sleep(1 * time.Second)
 	}
+}
 
-	return nil
+// getMainBranchHead returns the last commit on the main branch of repo.
+//
+// repo must have a main branch.
+func getMainBranchHead(ctx context.Context, instance *instance, repo Repository) (Commit, error) {
+	pathParams := map[string]string{
+		":workspace": repo.Workspace.Slug,
+		":repo_slug": repo.Slug,
+		":branch":    url.PathEscape(repo.MainBranch.Name),
+	}
+
+	var branch Refs
+	err := instance.GET(ctx, branchRepositoryEndpoint, pathParams, map[string]string{}, &branch)
+	if err != nil {
+		return Commit{}, err
+	}
+	return branch.Target, nil
+}
+
+// observeGrowth updates the size growth of repos since their last refresh.
+func (c *repositoriesCollector) observeGrowth(repos []Repository) {
+	c.growth.Lock()
+	defer c.growth.Unlock()
+
+	now := time.Now()
+	for _, v := range repos {
+		growth := sizeGrowthData{Size: v.Size, RefreshedAt: now}
+		if previous, ok := c.growth.data[v.Uuid]; ok {
+			growth.Rate = previous.Rate
+			if elapsed := now.Sub(previous.RefreshedAt).Seconds(); elapsed > 0 {
+				growth.Rate = (float64(v.Size) - float64(previous.Size)) / elapsed
+			}
+		}
+		c.growth.data[v.Uuid] = growth
+	}
+	c.growth.touch()
 }
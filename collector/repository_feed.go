@@ -0,0 +1,205 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+)
+
+// repositoryFeed passes the repositories fetched by repositoriesCollector
+// to the collectors working per repository.
+//
+// A channel is created for every registered collector when a run starts
+// and closed once all repositories are fetched, so those collectors can
+// finish their run.
+type repositoryFeed struct {
+	sync.Mutex
+	logger    *slog.Logger
+	consumers []string
+	channels  map[string]chan Repository
+	// whether every repository of the current run was published
+	complete bool
+}
+
+func newRepositoryFeed(logger *slog.Logger) *repositoryFeed {
+	return &repositoryFeed{
+		logger:   logger,
+		channels: map[string]chan Repository{},
+	}
+}
+
+// register adds a collector that reads repositories of every run.
+func (f *repositoryFeed) register(name string) {
+	f.Lock()
+	defer f.Unlock()
+	f.consumers = append(f.consumers, name)
+}
+
+// open creates the channels of a new run.
+func (f *repositoryFeed) open() {
+	f.Lock()
+	defer f.Unlock()
+	f.channels = map[string]chan Repository{}
+	f.complete = false
+	for _, name := range f.consumers {
+		f.channels[name] = make(chan Repository, 1)
+	}
+}
+
+// subscribe returns the channel of the current run for a collector.
+//
+// every subscriber must read the channel until it is closed, otherwise
+// publish blocks.
+func (f *repositoryFeed) subscribe(name string) <-chan Repository {
+	f.Lock()
+	defer f.Unlock()
+	return f.channels[name]
+}
+
+// publish sends repo to every collector of the current run.
+func (f *repositoryFeed) publish(ctx context.Context, repo Repository) error {
+	f.Lock()
+	channels := f.channels
+	f.Unlock()
+
+	for _, ch := range channels {
+		select {
+		case ch <- repo:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// close ends the current run, complete is false when the repositories
+// could not all be fetched.
+//
+// closed channels are kept until the next run, so a collector subscribing
+// late still sees the end of the run.
+func (f *repositoryFeed) close(complete bool) {
+	f.Lock()
+	defer f.Unlock()
+	f.complete = complete
+	for _, ch := range f.channels {
+		close(ch)
+	}
+}
+
+// completed reports whether every repository of the current run was
+// published, so the repositories not seen by a subscriber were deleted or
+// renamed.
+//
+// only meaningful once the channel of the subscriber is closed.
+func (f *repositoryFeed) completed() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.complete
+}
+
+// includesRepository reports whether repo matches a list of
+// `workspace/repo_slug`, or ["*"] for every repository.
+func includesRepository(included []string, repo Repository) bool {
+	if len(included) == 1 && included[0] == "*" {
+		return true
+	}
+	return slices.Contains(included, repo.Workspace.Slug+"/"+repo.Slug)
+}
+
+// collectRepositories collects the data of every repository of the current
+// run of the subscriber name accepted by include into holder, keyed by
+// repository uuid. Repositories are collected concurrently.
+//
+// A repository failing keeps the data of its previous run, its error is
+// returned once every repository is collected. A repository skipped, see
+// skippable, is logged and its data removed. Once the run is
+// completed, the repositories no longer accepted are removed from holder.
+func collectRepositories[T any](
+	feed *repositoryFeed,
+	name string,
+	include func(repo Repository) bool,
+	holder *DataHolder[map[string]T],
+	what string,
+	collect func(repo Repository) (T, error),
+) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	seen := map[string]bool{}
+
+	for repo := range feed.subscribe(name) {
+		if !include(repo) {
+			continue
+		}
+		seen[repo.Uuid] = true
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := collect(repo)
+			if skippable(err) {
+				feed.logger.Info("skipping repository", "collector", name, "repository", repo.FullName, "err", err)
+				holder.Lock()
+				delete(holder.data, repo.Uuid)
+				holder.touch()
+				holder.Unlock()
+				return
+			}
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("error collecting %s of %s: %w", what, repo.FullName, err))
+				mu.Unlock()
+				return
+			}
+			holder.Lock()
+			holder.data[repo.Uuid] = data
+			holder.touch()
+			holder.Unlock()
+		}()
+	}
+
+	// wait until every repository collected
+	wg.Wait()
+
+	if feed.completed() {
+		pruneRepositories(holder, seen)
+	}
+	return errors.Join(errs...)
+}
+
+// skippable reports whether err leaves a repository or workspace out of a
+// run instead of failing it: 403 when the credentials lack the permission an
+// endpoint needs, such as admin, and 404 when the repository was deleted
+// during the run or has the feature collected turned off.
+func skippable(err error) bool {
+	return errors.Is(err, errForbidden) || errors.Is(err, errNotFound)
+}
+
+// pruneRepositories removes from holder, keyed by repository uuid, the
+// repositories not seen in the last run.
+func pruneRepositories[T any](holder *DataHolder[map[string]T], seen map[string]bool) {
+	holder.Lock()
+	defer holder.Unlock()
+
+	for uuid := range holder.data {
+		if !seen[uuid] {
+			delete(holder.data, uuid)
+		}
+	}
+}
@@ -13,7 +13,11 @@
 
 package collector
 
-import "time"
+import (
+	"encoding/json"
+	"net/url"
+	"time"
+)
 
 // Response wrapper for pagination bitbucket
 type PaginationResponse[T any] struct {
@@ -23,6 +27,24 @@ type PaginationResponse[T any] struct {
 	Size    uint64  `json:"size"`
 }
 
+// NextParams returns the query params of the next page, or nil on the last page.
+//
+// page is not always a number, some endpoints use an opaque token.
+func (p *PaginationResponse[T]) NextParams() (map[string]string, error) {
+	if p.Next == nil || *p.Next == "" {
+		return nil, nil
+	}
+	next, err := url.Parse(*p.Next)
+	if err != nil {
+		return nil, err
+	}
+	params := map[string]string{}
+	for key := range next.Query() {
+		params[key] = next.Query().Get(key)
+	}
+	return params, nil
+}
+
 // Response wrapper for repository
 type Repository struct {
 	Slug      string    `json:"slug"`
@@ -38,6 +60,11 @@ type Repository struct {
 	HasIssues bool      `json:"has_issues"`
 	HasWiki   bool      `json:"has_wiki"`
 	IsPrivate bool      `json:"is_private"`
+	// empty repository has no main branch
+	MainBranch  *Refs  `json:"mainbranch"`
+	Description string `json:"description"`
+	// repository this one is forked from, nil when not a fork
+	Parent *Repository `json:"parent"`
 }
 
 // Response wrapper for workspace
@@ -52,19 +79,29 @@ type Project struct {
 	Key  string `json:"key"`
 	Uuid string `json:"uuid"`
 	Name string `json:"name"`
+	// only returned by the projects endpoint
+	IsPrivate bool      `json:"is_private"`
+	CreatedOn time.Time `json:"created_on"`
+	UpdatedOn time.Time `json:"updated_on"`
 }
 
 type Refs struct {
 	Name string `json:"name"`
 	Type string `json:"type"`
+	// commit the ref points to
+	Target Commit `json:"target"`
 }
 
 type Author struct {
 	User User `json:"user"`
+	// `name <email>` as written in the commit
+	Raw string `json:"raw"`
 }
 
 type Commit struct {
-	Author Author `json:"author"`
+	Hash   string    `json:"hash"`
+	Date   time.Time `json:"date"`
+	Author Author    `json:"author"`
 }
 
 type User struct {
@@ -72,3 +109,273 @@ type User struct {
 	Nickname    string `json:"nickname"`
 	Uuid        string `json:"uuid"`
 }
+
+// Response wrapper for a member of workspace
+type WorkspaceMembership struct {
+	User User `json:"user"`
+}
+
+// Response wrapper for a file or directory of the source tree
+type TreeEntry struct {
+	Path string `json:"path"`
+	// commit_file or commit_directory
+	Type string `json:"type"`
+	// bytes, only set for files
+	Size uint64 `json:"size"`
+	// binary, executable, image, link, lfs or subrepository
+	Attributes []string `json:"attributes"`
+}
+
+type BranchRestriction struct {
+	Id   uint64 `json:"id"`
+	Kind string `json:"kind"`
+	// glob or branching_model
+	BranchMatchKind string `json:"branch_match_kind"`
+	// glob pattern when branch_match_kind is glob
+	Pattern string `json:"pattern"`
+	// branch type of the branching model when branch_match_kind is branching_model
+	BranchType string `json:"branch_type"`
+	// number of approvals or builds, for kinds requiring it
+	Value *uint64 `json:"value"`
+}
+
+// Response wrapper for the branching model of a repository
+type BranchingModel struct {
+	Development *BranchingModelBranch `json:"development"`
+	Production  *BranchingModelBranch `json:"production"`
+	BranchTypes []BranchType          `json:"branch_types"`
+}
+
+type BranchingModelBranch struct {
+	Branch Refs `json:"branch"`
+}
+
+type BranchType struct {
+	Kind   string `json:"kind"`
+	Prefix string `json:"prefix"`
+}
+
+// Response wrapper for a build status reported on a commit
+type CommitStatus struct {
+	Key string `json:"key"`
+	// SUCCESSFUL, FAILED, INPROGRESS or STOPPED
+	State string `json:"state"`
+	Name  string `json:"name"`
+}
+
+// Response wrapper for a Code Insights report
+type Report struct {
+	Uuid       string `json:"uuid"`
+	ExternalId string `json:"external_id"`
+	Title      string `json:"title"`
+	Reporter   string `json:"reporter"`
+	// SECURITY, COVERAGE, TEST or BUG
+	ReportType string `json:"report_type"`
+	// PASSED, FAILED or PENDING
+	Result string       `json:"result"`
+	Data   []ReportData `json:"data"`
+}
+
+type ReportData struct {
+	// BOOLEAN, DATE, DURATION, LINK, NUMBER, PERCENTAGE or TEXT
+	Type  string          `json:"type"`
+	Title string          `json:"title"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Response wrapper for a Code Insights annotation
+type Annotation struct {
+	ExternalId     string `json:"external_id"`
+	AnnotationType string `json:"annotation_type"`
+	// CRITICAL, HIGH, MEDIUM or LOW
+	Severity string `json:"severity"`
+}
+
+// Response wrapper for an issue of the issue tracker
+type Issue struct {
+	Id uint64 `json:"id"`
+	// new, open, submitted, on hold, resolved, invalid, duplicate, wontfix or closed
+	State string `json:"state"`
+	// bug, enhancement, proposal or task
+	Kind string `json:"kind"`
+	// trivial, minor, major, critical or blocker
+	Priority  string    `json:"priority"`
+	CreatedOn time.Time `json:"created_on"`
+	UpdatedOn time.Time `json:"updated_on"`
+}
+
+// Response wrapper for webhook of repository or workspace
+type Webhook struct {
+	Uuid   string   `json:"uuid"`
+	Url    string   `json:"url"`
+	Active bool     `json:"active"`
+	Events []string `json:"events"`
+}
+
+// Response wrapper for deploy key of repository
+type DeployKey struct {
+	Id uint64 `json:"id"`
+	// public key, `<type> <base64 blob> [comment]`
+	Key       string    `json:"key"`
+	Label     string    `json:"label"`
+	CreatedOn time.Time `json:"created_on"`
+	// zero when never used
+	LastUsed time.Time `json:"last_used"`
+}
+
+// Response wrapper for ssh key of user
+type SSHKey struct {
+	Uuid string `json:"uuid"`
+	// public key, `<type> <base64 blob> [comment]`
+	Key       string    `json:"key"`
+	Label     string    `json:"label"`
+	CreatedOn time.Time `json:"created_on"`
+	// zero when never used
+	LastUsed time.Time `json:"last_used"`
+}
+
+// Response wrapper for pipeline variable, the value is left out on purpose
+type PipelineVariable struct {
+	Uuid    string `json:"uuid"`
+	Key     string `json:"key"`
+	Secured bool   `json:"secured"`
+}
+
+// Response wrapper for deployment environment
+type Environment struct {
+	Uuid string `json:"uuid"`
+	Name string `json:"name"`
+}
+
+// Response wrapper for self-hosted pipeline runner
+//
+// Runners are only served by the internal API.
+type Runner struct {
+	Uuid   string   `json:"uuid"`
+	Name   string   `json:"name"`
+	Labels []string `json:"labels"`
+	State  struct {
+		// ONLINE, OFFLINE, UNHEALTHY or DISABLED
+		Status  string `json:"status"`
+		Version struct {
+			Version string `json:"version"`
+		} `json:"version"`
+		// last state reported by the runner, which reports it on every
+		// heartbeat
+		UpdatedOn time.Time `json:"updated_on"`
+	} `json:"state"`
+}
+
+// Response wrapper for state of a pipeline or pipeline step
+type PipelineState struct {
+	// PENDING, IN_PROGRESS or COMPLETED
+	Name   string `json:"name"`
+	Result struct {
+		// SUCCESSFUL, FAILED, ERROR, STOPPED or NOT_RUN
+		Name string `json:"name"`
+	} `json:"result"`
+}
+
+// Response wrapper for a pipeline run
+type Pipeline struct {
+	Uuid        string        `json:"uuid"`
+	BuildNumber uint64        `json:"build_number"`
+	State       PipelineState `json:"state"`
+	Target      struct {
+		RefName string `json:"ref_name"`
+		Commit  struct {
+			Hash string `json:"hash"`
+		} `json:"commit"`
+	} `json:"target"`
+	CreatedOn   time.Time `json:"created_on"`
+	CompletedOn time.Time `json:"completed_on"`
+	// build time billed to the workspace
+	BuildSecondsUsed uint64 `json:"build_seconds_used"`
+}
+
+// Response wrapper for a step of a pipeline
+type PipelineStep struct {
+	Uuid  string        `json:"uuid"`
+	Name  string        `json:"name"`
+	State PipelineState `json:"state"`
+	Image struct {
+		Name string `json:"name"`
+	} `json:"image"`
+	StartedOn         time.Time `json:"started_on"`
+	CompletedOn       time.Time `json:"completed_on"`
+	DurationInSeconds float64   `json:"duration_in_seconds"`
+}
+
+// Response wrapper for test report summary of a pipeline step
+type TestReport struct {
+	NumberOfTestCases           uint64 `json:"number_of_test_cases"`
+	NumberOfSuccessfulTestCases uint64 `json:"number_of_successful_test_cases"`
+	NumberOfFailedTestCases     uint64 `json:"number_of_failed_test_cases"`
+	NumberOfErrorTestCases      uint64 `json:"number_of_error_test_cases"`
+	NumberOfSkippedTestCases    uint64 `json:"number_of_skipped_test_cases"`
+}
+
+// Response wrapper for a test case of a test report
+type TestCase struct {
+	Uuid               string `json:"uuid"`
+	Name               string `json:"name"`
+	FullyQualifiedName string `json:"fully_qualified_name"`
+	// SUCCESS, FAILED, ERROR or SKIPPED
+	Status string `json:"status"`
+}
+
+// Response wrapper for pull request
+type PullRequest struct {
+	Id uint64 `json:"id"`
+	// OPEN, MERGED, DECLINED or SUPERSEDED
+	State     string    `json:"state"`
+	Author    User      `json:"author"`
+	CreatedOn time.Time `json:"created_on"`
+	UpdatedOn time.Time `json:"updated_on"`
+	// only returned when asked with fields=+values.reviewers
+	Reviewers []User `json:"reviewers"`
+	// only returned when asked with fields=+values.participants
+	Participants []Participant `json:"participants"`
+	Source       struct {
+		// nil when the repository was deleted
+		Repository *Repository `json:"repository"`
+	} `json:"source"`
+}
+
+// Response wrapper for participant of pull request
+type Participant struct {
+	User User `json:"user"`
+	// REVIEWER or PARTICIPANT
+	Role string `json:"role"`
+	// approved, changes_requested or empty
+	State string `json:"state"`
+}
+
+// Response wrapper for an activity of pull request, only one field is set
+type PullRequestActivity struct {
+	Update *struct {
+		State  string    `json:"state"`
+		Date   time.Time `json:"date"`
+		Author User      `json:"author"`
+	} `json:"update"`
+	Approval *struct {
+		Date time.Time `json:"date"`
+		User User      `json:"user"`
+	} `json:"approval"`
+	ChangesRequested *struct {
+		Date time.Time `json:"date"`
+		User User      `json:"user"`
+	} `json:"changes_requested"`
+	Comment *struct {
+		CreatedOn time.Time `json:"created_on"`
+		User      User      `json:"user"`
+	} `json:"comment"`
+}
+
+// Response wrapper for diffstat of a changed file
+type Diffstat struct {
+	// added, removed, modified or renamed
+	Status       string `json:"status"`
+	LinesAdded   uint64 `json:"lines_added"`
+	LinesRemoved uint64 `json:"lines_removed"`
+}
@@ -0,0 +1,362 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/nandanurseptama/bitbucket-exporter/config"
+	"github.com/nandanurseptama/bitbucket-exporter/helpers"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// restrictions of a branch pattern
+type branchPatternData struct {
+	Pattern string `json:"pattern"`
+	// glob or branching_model
+	MatchKind                        string `json:"match_kind"`
+	PushRestricted                   bool   `json:"push_restricted"`
+	ForcePushBlocked                 bool   `json:"force_push_blocked"`
+	DeleteBlocked                    bool   `json:"delete_blocked"`
+	RequiredApprovals                uint64 `json:"required_approvals"`
+	RequiredDefaultReviewerApprovals uint64 `json:"required_default_reviewer_approvals"`
+	RequiredPassingBuilds            uint64 `json:"required_passing_builds"`
+}
+
+type restrictionData struct {
+	Workspace  string `json:"workspace"`
+	Project    string `json:"project"`
+	Repository string `json:"repository"`
+	// empty when repository has no commit
+	MainBranch          string `json:"main_branch"`
+	MainBranchProtected bool   `json:"main_branch_protected"`
+	HasDefaultReviewers bool   `json:"has_default_reviewers"`
+	// keyed by match kind and pattern
+	Patterns map[string]*branchPatternData `json:"patterns"`
+}
+
+// restrictionPatternMetric is exported per repository and branch pattern.
+type restrictionPatternMetric struct {
+	desc  *prometheus.Desc
+	value func(v *branchPatternData) float64
+}
+
+var (
+	restrictionLabels        = []string{"workspace", "project", "repository"}
+	restrictionPatternLabels = []string{"workspace", "project", "repository", "pattern", "match_kind"}
+
+	restrictionMainBranchProtectedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemRestriction,
+			"main_branch_protected",
+		),
+		"Whether push, force push or delete is restricted on the main branch of this repo",
+		append(restrictionLabels, "main_branch"),
+		nil,
+	)
+	restrictionHasDefaultReviewersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemRestriction,
+			"has_default_reviewers",
+		),
+		"Whether this repo has default reviewers",
+		restrictionLabels,
+		nil,
+	)
+
+	restrictionPatternMetrics = []restrictionPatternMetric{
+		newRestrictionPatternMetric("push_restricted", "Whether push is restricted to some users or groups", func(v *branchPatternData) float64 {
+			return helpers.BoolToFloat(v.PushRestricted)
+		}),
+		newRestrictionPatternMetric("force_push_blocked", "Whether force push is blocked", func(v *branchPatternData) float64 {
+			return helpers.BoolToFloat(v.ForcePushBlocked)
+		}),
+		newRestrictionPatternMetric("delete_blocked", "Whether branch deletion is blocked", func(v *branchPatternData) float64 {
+			return helpers.BoolToFloat(v.DeleteBlocked)
+		}),
+		newRestrictionPatternMetric("required_approvals", "Total approval required to merge", func(v *branchPatternData) float64 {
+			return float64(v.RequiredApprovals)
+		}),
+		newRestrictionPatternMetric("required_default_reviewer_approvals", "Total default reviewer approval required to merge", func(v *branchPatternData) float64 {
+			return float64(v.RequiredDefaultReviewerApprovals)
+		}),
+		newRestrictionPatternMetric("required_passing_builds", "Total passing build required to merge", func(v *branchPatternData) float64 {
+			return float64(v.RequiredPassingBuilds)
+		}),
+	}
+)
+
+func newRestrictionPatternMetric(name, help string, value func(v *branchPatternData) float64) restrictionPatternMetric {
+	return restrictionPatternMetric{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(
+				namespace,
+				subSystemRestriction,
+				name,
+			),
+			help,
+			restrictionPatternLabels,
+			nil,
+		),
+		value: value,
+	}
+}
+
+type restrictionCollector struct {
+	config *config.BranchRestrictionsCollectorConfig
+	feed   *repositoryFeed
+	// keyed by repository uuid
+	holders *DataHolder[map[string]restrictionData]
+}
+
+func NewRestrictionCollector(
+	config *config.BranchRestrictionsCollectorConfig,
+	feed *repositoryFeed,
+) *restrictionCollector {
+	return &restrictionCollector{
+		config: config,
+		feed:   feed,
+		holders: &DataHolder[map[string]restrictionData]{
+			data: map[string]restrictionData{},
+		},
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *restrictionCollector) Collect(ch chan<- prometheus.Metric) {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+
+	for _, v := range c.holders.data {
+		labels := []string{v.Workspace, v.Project, v.Repository}
+		if v.MainBranch != "" {
+			ch <- prometheus.MustNewConstMetric(
+				restrictionMainBranchProtectedDesc,
+				prometheus.GaugeValue,
+				helpers.BoolToFloat(v.MainBranchProtected),
+				append(labels, v.MainBranch)...,
+			)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			restrictionHasDefaultReviewersDesc,
+			prometheus.GaugeValue,
+			helpers.BoolToFloat(v.HasDefaultReviewers),
+			labels...,
+		)
+
+		for _, pattern := range v.Patterns {
+			patternLabels := []string{v.Workspace, v.Project, v.Repository, pattern.Pattern, pattern.MatchKind}
+			for _, metric := range restrictionPatternMetrics {
+				ch <- prometheus.MustNewConstMetric(
+					metric.desc,
+					prometheus.GaugeValue,
+					metric.value(pattern),
+					patternLabels...,
+				)
+			}
+		}
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *restrictionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- restrictionMainBranchProtectedDesc
+	ch <- restrictionHasDefaultReviewersDesc
+	for _, metric := range restrictionPatternMetrics {
+		ch <- metric.desc
+	}
+}
+
+func (c *restrictionCollector) dataHolders() map[string]holder {
+	return map[string]holder{"repositories": c.holders}
+}
+
+func (c *restrictionCollector) repositoryCount() int {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+	return len(c.holders.data)
+}
+
+func (c *restrictionCollector) Exec(ctx context.Context, instance *instance) error {
+	return collectRepositories(
+		c.feed,
+		keyRestrictionCollector,
+		func(repo Repository) bool {
+			return includesRepository(c.config.IncludedRepository, repo)
+		},
+		c.holders,
+		"branch restrictions",
+		func(repo Repository) (restrictionData, error) {
+			return c.getRestrictions(ctx, instance, repo)
+		},
+	)
+}
+
+func (c *restrictionCollector) getRestrictions(
+	ctx context.Context,
+	instance *instance,
+	repo Repository,
+) (restrictionData, error) {
+	data := restrictionData{
+		Workspace:  repo.Workspace.Slug,
+		Project:    repo.Project.Key,
+		Repository: repo.Slug,
+		Patterns:   map[string]*branchPatternData{},
+	}
+	if repo.MainBranch != nil {
+		data.MainBranch = repo.MainBranch.Name
+	}
+	pathParams := map[string]string{":workspace": repo.Workspace.Slug, ":repo_slug": repo.Slug}
+
+	var model BranchingModel
+	err := instance.GET(ctx, branchingModelEndpoint, pathParams, map[string]string{}, &model)
+	if err != nil {
+		return data, err
+	}
+
+	err = getAllPages(
+		ctx,
+		instance,
+		branchRestrictionsEndpoint,
+		pathParams,
+		map[string]string{"pagelen": "100"},
+		func(values []BranchRestriction) error {
+			for _, v := range values {
+				pattern := v.Pattern
+				if v.BranchMatchKind == "branching_model" {
+					pattern = v.BranchType
+				}
+				key := v.BranchMatchKind + ":" + pattern
+				p := data.Patterns[key]
+				if p == nil {
+					p = &branchPatternData{Pattern: pattern, MatchKind: v.BranchMatchKind}
+					data.Patterns[key] = p
+				}
+
+				var value uint64
+				if v.Value != nil {
+					value = *v.Value
+				}
+				switch v.Kind {
+				case "push":
+					p.PushRestricted = true
+				case "force":
+					p.ForcePushBlocked = true
+				case "delete":
+					p.DeleteBlocked = true
+				case "require_approvals_to_merge":
+					p.RequiredApprovals = value
+				case "require_default_reviewer_approvals_to_merge":
+					p.RequiredDefaultReviewerApprovals = value
+				case "require_passing_builds_to_merge":
+					p.RequiredPassingBuilds = value
+				default:
+					continue
+				}
+
+				if data.MainBranch != "" && protectsBranch(v, data.MainBranch, model) {
+					data.MainBranchProtected = true
+				}
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return data, err
+	}
+
+	var reviewers PaginationResponse[any]
+	err = instance.GET(ctx, defaultReviewersEndpoint, pathParams, map[string]string{}, &reviewers)
+	if err != nil {
+		return data, err
+	}
+	data.HasDefaultReviewers = len(reviewers.Values) > 0
+
+	return data, nil
+}
+
+// getMainBranchProtected reports whether push, force push or delete is
+// restricted on the main branch of repo.
+//
+// repo must have a main branch.
+func getMainBranchProtected(ctx context.Context, instance *instance, repo Repository) (bool, error) {
+	pathParams := map[string]string{":workspace": repo.Workspace.Slug, ":repo_slug": repo.Slug}
+
+	var model BranchingModel
+	err := instance.GET(ctx, branchingModelEndpoint, pathParams, map[string]string{}, &model)
+	if err != nil {
+		return false, err
+	}
+
+	protected := false
+	err = getAllPages(
+		ctx,
+		instance,
+		branchRestrictionsEndpoint,
+		pathParams,
+		map[string]string{"pagelen": "100"},
+		func(values []BranchRestriction) error {
+			for _, v := range values {
+				if protectsBranch(v, repo.MainBranch.Name, model) {
+					protected = true
+					return errLastPage
+				}
+			}
+			return nil
+		},
+	)
+	return protected, err
+}
+
+// protectsBranch reports whether restriction r restricts push, force push
+// or delete of branch.
+func protectsBranch(r BranchRestriction, branch string, model BranchingModel) bool {
+	switch r.Kind {
+	case "push", "force", "delete":
+		return restrictionAppliesTo(r, branch, model)
+	}
+	return false
+}
+
+// restrictionAppliesTo reports whether restriction r matches branch.
+func restrictionAppliesTo(r BranchRestriction, branch string, model BranchingModel) bool {
+	if r.BranchMatchKind != "branching_model" {
+		return globMatch(r.Pattern, branch)
+	}
+
+	switch r.BranchType {
+	case "development":
+		return model.Development != nil && model.Development.Branch.Name == branch
+	case "production":
+		return model.Production != nil && model.Production.Branch.Name == branch
+	}
+	for _, t := range model.BranchTypes {
+		if t.Kind == r.BranchType && t.Prefix != "" && strings.HasPrefix(branch, t.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// globMatch matches branch against a Bitbucket glob, where `*` also
+// matches `/`.
+func globMatch(pattern, branch string) bool {
+	expr := "^" + helpers.StrReplace(regexp.QuoteMeta(pattern), map[string]string{`\*`: ".*"}) + "$"
+	matched, err := regexp.MatchString(expr, branch)
+	return err == nil && matched
+}
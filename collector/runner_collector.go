@@ -0,0 +1,258 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nandanurseptama/bitbucket-exporter/config"
+	"github.com/nandanurseptama/bitbucket-exporter/helpers"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// states of a runner, always exported so a dashboard sees every state
+var runnerStates = []string{"ONLINE", "OFFLINE", "UNHEALTHY"}
+
+type runnerData struct {
+	Uuid    string   `json:"uuid"`
+	Name    string   `json:"name"`
+	Labels  []string `json:"labels"`
+	State   string   `json:"state"`
+	Version string   `json:"version"`
+	// last state reported by the runner, it reports it on every heartbeat
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+}
+
+type runnerOwnerData struct {
+	Workspace string `json:"workspace"`
+	// project and repository are empty for workspace runners
+	Project    string       `json:"project"`
+	Repository string       `json:"repository"`
+	Runners    []runnerData `json:"runners"`
+}
+
+var (
+	runnerLabels = []string{"workspace", "project", "repository", "runner", "uuid"}
+
+	runnerInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemRunner,
+			"info",
+		),
+		"Version and labels of this self-hosted runner, repository is empty for workspace runners",
+		append(runnerLabels, "version", "labels"),
+		nil,
+	)
+	runnerStateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemRunner,
+			"state",
+		),
+		"Whether this self-hosted runner is in this state",
+		append(runnerLabels, "state"),
+		nil,
+	)
+	runnerLastHeartbeatDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemRunner,
+			"last_heartbeat_timestamp_seconds",
+		),
+		"Timestamp of the last heartbeat of this self-hosted runner, as of the last collection",
+		runnerLabels,
+		nil,
+	)
+)
+
+type runnerCollector struct {
+	config     *config.RunnerCollectorConfig
+	workspaces []string
+	feed       *repositoryFeed
+	// keyed by repository uuid
+	holders *DataHolder[map[string]runnerOwnerData]
+	// keyed by workspace slug
+	workspaceHolders *DataHolder[map[string]runnerOwnerData]
+}
+
+func NewRunnerCollector(
+	config *config.RunnerCollectorConfig,
+	workspaces []string,
+	feed *repositoryFeed,
+) *runnerCollector {
+	return &runnerCollector{
+		config:     config,
+		workspaces: workspaces,
+		feed:       feed,
+		holders: &DataHolder[map[string]runnerOwnerData]{
+			data: map[string]runnerOwnerData{},
+		},
+		workspaceHolders: &DataHolder[map[string]runnerOwnerData]{
+			data: map[string]runnerOwnerData{},
+		},
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *runnerCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, v := range holderValues(c.holders, c.workspaceHolders) {
+		for _, runner := range v.Runners {
+			labels := []string{v.Workspace, v.Project, v.Repository, runner.Name, runner.Uuid}
+			ch <- prometheus.MustNewConstMetric(
+				runnerInfoDesc,
+				prometheus.GaugeValue,
+				1,
+				append(labels, runner.Version, strings.Join(runner.Labels, ","))...,
+			)
+
+			states := runnerStates
+			if !slices.Contains(states, runner.State) {
+				states = append(slices.Clone(states), runner.State)
+			}
+			for _, state := range states {
+				ch <- prometheus.MustNewConstMetric(
+					runnerStateDesc,
+					prometheus.GaugeValue,
+					helpers.BoolToFloat(runner.State == state),
+					append(labels, state)...,
+				)
+			}
+
+			if !runner.LastHeartbeat.IsZero() {
+				ch <- prometheus.MustNewConstMetric(
+					runnerLastHeartbeatDesc,
+					prometheus.GaugeValue,
+					float64(runner.LastHeartbeat.Unix()),
+					labels...,
+				)
+			}
+		}
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *runnerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- runnerInfoDesc
+	ch <- runnerStateDesc
+	ch <- runnerLastHeartbeatDesc
+}
+
+func (c *runnerCollector) dataHolders() map[string]holder {
+	return map[string]holder{"runners": c.holders, "workspace_runners": c.workspaceHolders}
+}
+
+func (c *runnerCollector) repositoryCount() int {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+	return len(c.holders.data)
+}
+
+func (c *runnerCollector) Exec(ctx context.Context, instance *instance) error {
+	var wg sync.WaitGroup
+	var workspaceErrs []error
+
+	if c.config.CollectWorkspaceRunners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, workspace := range c.workspaces {
+				data := runnerOwnerData{Workspace: workspace}
+				runners, err := getRunners(ctx, instance, workspaceRunnersEndpoint, map[string]string{":workspace": workspace})
+				if skippable(err) {
+					c.feed.logger.Info("skipping workspace", "collector", keyRunnerCollector, "workspace", workspace, "err", err)
+					c.workspaceHolders.Lock()
+					delete(c.workspaceHolders.data, workspace)
+					c.workspaceHolders.touch()
+					c.workspaceHolders.Unlock()
+					continue
+				}
+				if err != nil {
+					workspaceErrs = append(workspaceErrs, fmt.Errorf("error collecting runners of %s: %w", workspace, err))
+					continue
+				}
+				data.Runners = runners
+				c.workspaceHolders.Lock()
+				c.workspaceHolders.data[workspace] = data
+				c.workspaceHolders.touch()
+				c.workspaceHolders.Unlock()
+			}
+		}()
+	}
+
+	err := collectRepositories(
+		c.feed,
+		keyRunnerCollector,
+		func(repo Repository) bool {
+			return includesRepository(c.config.IncludedRepository, repo)
+		},
+		c.holders,
+		"runners",
+		func(repo Repository) (runnerOwnerData, error) {
+			data := runnerOwnerData{
+				Workspace:  repo.Workspace.Slug,
+				Project:    repo.Project.Key,
+				Repository: repo.Slug,
+			}
+			pathParams := map[string]string{":workspace": repo.Workspace.Slug, ":repo_slug": repo.Slug}
+			runners, err := getRunners(ctx, instance, repositoryRunnersEndpoint, pathParams)
+			data.Runners = runners
+			return data, err
+		},
+	)
+
+	// wait until runners of every workspace collected
+	wg.Wait()
+	return errors.Join(append(workspaceErrs, err)...)
+}
+
+// getRunners returns the self-hosted runners at endpoint of the internal
+// API, the public one does not serve them.
+func getRunners(
+	ctx context.Context,
+	instance *instance,
+	endpoint string,
+	pathParams map[string]string,
+) ([]runnerData, error) {
+	var runners []runnerData
+	err := getAllInternalPages(
+		ctx,
+		instance,
+		endpoint,
+		pathParams,
+		map[string]string{"pagelen": "100"},
+		func(values []Runner) error {
+			for _, v := range values {
+				// sorted so the labels of a series stay the same
+				slices.Sort(v.Labels)
+				runners = append(runners, runnerData{
+					Uuid:          v.Uuid,
+					Name:          v.Name,
+					Labels:        v.Labels,
+					State:         v.State.Status,
+					Version:       v.State.Version.Version,
+					LastHeartbeat: v.State.UpdatedOn,
+				})
+			}
+			return nil
+		},
+	)
+	return runners, err
+}
@@ -0,0 +1,309 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+
+	"github.com/nandanurseptama/bitbucket-exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// label value of the series folding the ones cut by a series limit
+const otherLabelValue = "other"
+
+var seriesDroppedCounterVec = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subSystemExporter,
+		Name:      "series_dropped_total",
+		Help:      "Total series folded into `other` or dropped by the series limit of a collector, counted at every scrape.",
+	},
+	[]string{"collector"},
+)
+
+// additiveDescs are the gauges counting or sizing something, which a series
+// limit sums into `other` like counters and histograms. The series cut from
+// other gauges, such as timestamps, ratios and 0/1 flags, are dropped.
+var additiveDescs = map[*prometheus.Desc]bool{
+	codeInsightsAnnotationsDesc:      true,
+	codeOwnersDefaultReviewersDesc:   true,
+	codeOwnersOrphanedTotalDesc:      true,
+	repoTotalCommitDesc:              true,
+	userTotalCommitDesc:              true,
+	teamTotalCommitDesc:              true,
+	commitStatusTotalDesc:            true,
+	forkTotalDesc:                    true,
+	forkOpenPullRequestsDesc:         true,
+	forkOpenForkPullRequestsDesc:     true,
+	hygieneWorkspaceRepositoriesDesc: true,
+	hygieneWorkspaceSignalDesc:       true,
+	issueTotalDesc:                   true,
+	deployKeyDescs.total:             true,
+	sshKeyDescs.total:                true,
+	lfsFilesDesc:                     true,
+	lfsSizeDesc:                      true,
+	lfsWorkspaceFilesDesc:            true,
+	lfsWorkspaceSizeDesc:             true,
+	bitbucketTotalMemberDesc:         true,
+	pipelineStepRunsDesc:             true,
+	pipelineTestCasesDesc:            true,
+	pipelineTestCaseFailuresDesc:     true,
+	pipelineTestCaseFlakyDesc:        true,
+	pipelineVariableTotalDesc:        true,
+	popularityWatchersDesc:           true,
+	popularityForksDesc:              true,
+	projectRepositoriesDesc:          true,
+	projectSizeDesc:                  true,
+	projectTotalBranchDesc:           true,
+	projectTotalTagDesc:              true,
+	projectTotalCommitDesc:           true,
+	pullRequestReviewerAwaitingDesc:  true,
+	pullRequestTeamAwaitingDesc:      true,
+	repositoryRefsTotalBranch:        true,
+	repositoryRefsTotalTag:           true,
+	repoSizeDesc:                     true,
+	languageRepositoriesDesc:         true,
+	languageSizeDesc:                 true,
+	webhookTotalDesc:                 true,
+	webhookActiveDesc:                true,
+	webhookEventsDesc:                true,
+	webhookHostDesc:                  true,
+	webhookNotAllowedDesc:            true,
+	workspaceSeatsDesc:               true,
+	workspaceMinutesUsedDesc:         true,
+	workspaceRepositoryMinutesDesc:   true,
+}
+
+// limitedCollector cuts the metrics of a collector having more series than
+// its limit.
+type limitedCollector struct {
+	Collector
+	name   string
+	config *config.SeriesLimitConfig
+}
+
+// series is a metric of a collector with its written value.
+type series struct {
+	metric prometheus.Metric
+	dto    *dto.Metric
+	value  float64
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *limitedCollector) Collect(ch chan<- prometheus.Metric) {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		c.Collector.Collect(metrics)
+		close(metrics)
+	}()
+
+	// grouped by metric, in the order they are collected
+	var descs []*prometheus.Desc
+	families := map[*prometheus.Desc][]prometheus.Metric{}
+	for m := range metrics {
+		if _, ok := families[m.Desc()]; !ok {
+			descs = append(descs, m.Desc())
+		}
+		families[m.Desc()] = append(families[m.Desc()], m)
+	}
+
+	topN := c.config.TopN
+	if topN <= 0 || topN >= c.config.MaxSeries {
+		topN = c.config.MaxSeries - 1
+	}
+
+	for _, desc := range descs {
+		family := families[desc]
+		if len(family) <= c.config.MaxSeries {
+			for _, m := range family {
+				ch <- m
+			}
+			continue
+		}
+
+		kept, other := cutSeries(family, c.config.MaxSeries, topN)
+		for _, m := range kept {
+			ch <- m
+		}
+		if other != nil {
+			ch <- other
+		}
+		if dropped := len(family) - len(kept); dropped > 0 {
+			seriesDroppedCounterVec.WithLabelValues(c.name).Add(float64(dropped))
+		}
+	}
+}
+
+// cutSeries returns the topN series of family by value, and the rest
+// folded into one series. The maxSeries highest series are kept and the
+// rest dropped when family cannot be folded, other is then nil.
+func cutSeries(family []prometheus.Metric, maxSeries, topN int) (kept []prometheus.Metric, other prometheus.Metric) {
+	var all []series
+	for _, m := range family {
+		out := &dto.Metric{}
+		if err := m.Write(out); err != nil {
+			return family, nil
+		}
+		all = append(all, series{metric: m, dto: out, value: seriesValue(out)})
+	}
+
+	slices.SortFunc(all, func(a, b series) int {
+		if c := cmp.Compare(b.value, a.value); c != 0 {
+			return c
+		}
+		// same series kept from one scrape to the next
+		return strings.Compare(a.dto.String(), b.dto.String())
+	})
+
+	if !additive(family[0].Desc(), all[0].dto) {
+		for _, v := range all[:maxSeries] {
+			kept = append(kept, v.metric)
+		}
+		return kept, nil
+	}
+
+	rest := make([]*dto.Metric, 0, len(all)-topN)
+	for _, v := range all[topN:] {
+		rest = append(rest, v.dto)
+	}
+	folded := foldSeries(rest)
+	if folded == nil {
+		return family, nil
+	}
+
+	for _, v := range all[:topN] {
+		// a kept series with the labels of the folded one, such as a real
+		// `other` value, is folded too so they do not collide. Its labels
+		// being the folded ones, folding it leaves them unchanged.
+		if sameLabels(v.dto, folded) {
+			folded = foldSeries(append(rest, v.dto))
+			continue
+		}
+		kept = append(kept, v.metric)
+	}
+	return kept, &foldedMetric{desc: family[0].Desc(), dto: folded}
+}
+
+// additive reports whether the series of desc, written as m, can be summed.
+func additive(desc *prometheus.Desc, m *dto.Metric) bool {
+	return m.Counter != nil || m.Histogram != nil || (m.Gauge != nil && additiveDescs[desc])
+}
+
+// sameLabels reports whether a and b have the same label values, both being
+// series of one family.
+func sameLabels(a, b *dto.Metric) bool {
+	return slices.EqualFunc(a.Label, b.Label, func(x, y *dto.LabelPair) bool {
+		return x.GetValue() == y.GetValue()
+	})
+}
+
+// seriesValue returns the value series are ranked by, the count of
+// observations for histograms.
+func seriesValue(m *dto.Metric) float64 {
+	switch {
+	case m.Gauge != nil:
+		return m.Gauge.GetValue()
+	case m.Counter != nil:
+		return m.Counter.GetValue()
+	case m.Untyped != nil:
+		return m.Untyped.GetValue()
+	case m.Histogram != nil:
+		return float64(m.Histogram.GetSampleCount())
+	}
+	return 0
+}
+
+// foldSeries sums metrics of a family into one series. A label keeps its
+// value when the metrics share it, and is `other` otherwise.
+//
+// nil is returned for the types which cannot be summed.
+func foldSeries(metrics []*dto.Metric) *dto.Metric {
+	first := metrics[0]
+	out := &dto.Metric{}
+	for i, pair := range first.Label {
+		value := pair.GetValue()
+		for _, m := range metrics[1:] {
+			if m.Label[i].GetValue() != value {
+				value = otherLabelValue
+				break
+			}
+		}
+		out.Label = append(out.Label, &dto.LabelPair{Name: pair.Name, Value: &value})
+	}
+
+	switch {
+	case first.Gauge != nil:
+		var sum float64
+		for _, m := range metrics {
+			sum += m.Gauge.GetValue()
+		}
+		out.Gauge = &dto.Gauge{Value: &sum}
+	case first.Counter != nil:
+		var sum float64
+		for _, m := range metrics {
+			sum += m.Counter.GetValue()
+		}
+		out.Counter = &dto.Counter{Value: &sum}
+	case first.Untyped != nil:
+		var sum float64
+		for _, m := range metrics {
+			sum += m.Untyped.GetValue()
+		}
+		out.Untyped = &dto.Untyped{Value: &sum}
+	case first.Histogram != nil:
+		var count uint64
+		var sum float64
+		// the metrics of a family share their buckets
+		buckets := make([]*dto.Bucket, len(first.Histogram.Bucket))
+		for i, bucket := range first.Histogram.Bucket {
+			buckets[i] = &dto.Bucket{UpperBound: bucket.UpperBound, CumulativeCount: new(uint64)}
+		}
+		for _, m := range metrics {
+			count += m.Histogram.GetSampleCount()
+			sum += m.Histogram.GetSampleSum()
+			for i, bucket := range m.Histogram.Bucket {
+				if i < len(buckets) {
+					*buckets[i].CumulativeCount += bucket.GetCumulativeCount()
+				}
+			}
+		}
+		out.Histogram = &dto.Histogram{SampleCount: &count, SampleSum: &sum, Bucket: buckets}
+	default:
+		return nil
+	}
+	return out
+}
+
+// foldedMetric is the series folding the ones cut by a series limit.
+type foldedMetric struct {
+	desc *prometheus.Desc
+	dto  *dto.Metric
+}
+
+func (m *foldedMetric) Desc() *prometheus.Desc {
+	return m.desc
+}
+
+func (m *foldedMetric) Write(out *dto.Metric) error {
+	out.Label = m.dto.Label
+	out.Gauge = m.dto.Gauge
+	out.Counter = m.dto.Counter
+	out.Untyped = m.dto.Untyped
+	out.Histogram = m.dto.Histogram
+	return nil
+}
@@ -0,0 +1,231 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/nandanurseptama/bitbucket-exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	testCounterDesc   = prometheus.NewDesc("test_counter", "Test counter", []string{"repository", "user"}, nil)
+	testGaugeDesc     = prometheus.NewDesc("test_gauge", "Test gauge", []string{"repository"}, nil)
+	testHistogramDesc = prometheus.NewDesc("test_histogram", "Test histogram", []string{"repository"}, nil)
+)
+
+// testCollector collects its metrics as is.
+type testCollector struct {
+	metrics []prometheus.Metric
+}
+
+func (c *testCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c.metrics {
+		ch <- m
+	}
+}
+
+func (c *testCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c *testCollector) Exec(ctx context.Context, instance *instance) error {
+	return nil
+}
+
+func counter(value float64, labels ...string) prometheus.Metric {
+	return prometheus.MustNewConstMetric(testCounterDesc, prometheus.CounterValue, value, labels...)
+}
+
+func gauge(desc *prometheus.Desc, value float64, labels ...string) prometheus.Metric {
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value, labels...)
+}
+
+func histogram(count uint64, sum float64, buckets map[float64]uint64, labels ...string) prometheus.Metric {
+	return prometheus.MustNewConstHistogram(testHistogramDesc, count, sum, buckets, labels...)
+}
+
+func TestLimitedCollector(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    config.SeriesLimitConfig
+		metrics   []prometheus.Metric
+		want      map[string]float64
+		wantDrops float64
+	}{
+		{
+			name:   "under the limit",
+			config: config.SeriesLimitConfig{MaxSeries: 2},
+			metrics: []prometheus.Metric{
+				counter(1, "a", "alice"),
+				counter(2, "b", "alice"),
+			},
+			want: map[string]float64{"a,alice": 1, "b,alice": 2},
+		},
+		{
+			name:   "max_series 1 folds every series",
+			config: config.SeriesLimitConfig{MaxSeries: 1},
+			metrics: []prometheus.Metric{
+				counter(1, "a", "alice"),
+				counter(2, "b", "alice"),
+				counter(3, "c", "alice"),
+			},
+			want:      map[string]float64{"other,alice": 6},
+			wantDrops: 3,
+		},
+		{
+			name:   "top_n at or above max_series keeps max_series - 1",
+			config: config.SeriesLimitConfig{MaxSeries: 2, TopN: 5},
+			metrics: []prometheus.Metric{
+				counter(1, "a", "alice"),
+				counter(5, "b", "bob"),
+				counter(3, "c", "carol"),
+			},
+			want:      map[string]float64{"b,bob": 5, "other,other": 4},
+			wantDrops: 2,
+		},
+		{
+			name:   "mixed labels keep the shared values",
+			config: config.SeriesLimitConfig{MaxSeries: 3, TopN: 1},
+			metrics: []prometheus.Metric{
+				counter(9, "a", "alice"),
+				counter(1, "b", "bob"),
+				counter(2, "c", "bob"),
+				counter(3, "d", "bob"),
+			},
+			want:      map[string]float64{"a,alice": 9, "other,bob": 6},
+			wantDrops: 3,
+		},
+		{
+			name:   "kept series labelled other is folded too",
+			config: config.SeriesLimitConfig{MaxSeries: 2, TopN: 1},
+			metrics: []prometheus.Metric{
+				counter(9, "other", "alice"),
+				counter(1, "b", "alice"),
+				counter(2, "c", "alice"),
+			},
+			want:      map[string]float64{"other,alice": 12},
+			wantDrops: 3,
+		},
+		{
+			name:   "gauge not additive is dropped",
+			config: config.SeriesLimitConfig{MaxSeries: 2, TopN: 1},
+			metrics: []prometheus.Metric{
+				gauge(testGaugeDesc, 0.5, "a"),
+				gauge(testGaugeDesc, 0.9, "b"),
+				gauge(testGaugeDesc, 0.1, "c"),
+			},
+			want:      map[string]float64{"a": 0.5, "b": 0.9},
+			wantDrops: 1,
+		},
+		{
+			name:   "additive gauge is folded",
+			config: config.SeriesLimitConfig{MaxSeries: 2, TopN: 1},
+			metrics: []prometheus.Metric{
+				gauge(languageRepositoriesDesc, 4, "w", "P", "go"),
+				gauge(languageRepositoriesDesc, 2, "w", "P", "java"),
+				gauge(languageRepositoriesDesc, 1, "w", "P", "rust"),
+			},
+			// labels are written sorted by name: language, project, workspace
+			want:      map[string]float64{"go,P,w": 4, "other,P,w": 3},
+			wantDrops: 2,
+		},
+		{
+			name:   "histograms are ranked by count and folded",
+			config: config.SeriesLimitConfig{MaxSeries: 2, TopN: 1},
+			metrics: []prometheus.Metric{
+				histogram(1, 10, map[float64]uint64{1: 0, 10: 1}, "a"),
+				histogram(4, 8, map[float64]uint64{1: 2, 10: 4}, "b"),
+				histogram(2, 3, map[float64]uint64{1: 1, 10: 2}, "c"),
+			},
+			want:      map[string]float64{"b": 4, "other": 3},
+			wantDrops: 2,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := "test_" + string(rune('a'+i))
+			c := &limitedCollector{
+				Collector: &testCollector{metrics: tt.metrics},
+				name:      name,
+				config:    &tt.config,
+			}
+
+			ch := make(chan prometheus.Metric)
+			go func() {
+				c.Collect(ch)
+				close(ch)
+			}()
+			got := map[string]float64{}
+			for m := range ch {
+				out := &dto.Metric{}
+				if err := m.Write(out); err != nil {
+					t.Fatal(err)
+				}
+				var values []string
+				for _, pair := range out.Label {
+					values = append(values, pair.GetValue())
+				}
+				key := strings.Join(values, ",")
+				if _, ok := got[key]; ok {
+					t.Errorf("series %q collected twice", key)
+				}
+				got[key] = seriesValue(out)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("series = %v, want %v", got, tt.want)
+			}
+
+			dropped := &dto.Metric{}
+			if err := seriesDroppedCounterVec.WithLabelValues(name).Write(dropped); err != nil {
+				t.Fatal(err)
+			}
+			if got := dropped.Counter.GetValue(); got != tt.wantDrops {
+				t.Errorf("series dropped = %v, want %v", got, tt.wantDrops)
+			}
+		})
+	}
+}
+
+func TestFoldSeriesHistogram(t *testing.T) {
+	var metrics []*dto.Metric
+	for _, m := range []prometheus.Metric{
+		histogram(1, 10, map[float64]uint64{1: 0, 10: 1}, "a"),
+		histogram(2, 3, map[float64]uint64{1: 1, 10: 2}, "b"),
+	} {
+		out := &dto.Metric{}
+		if err := m.Write(out); err != nil {
+			t.Fatal(err)
+		}
+		metrics = append(metrics, out)
+	}
+
+	folded := foldSeries(metrics)
+	if got := folded.Histogram.GetSampleCount(); got != 3 {
+		t.Errorf("count = %v, want 3", got)
+	}
+	if got := folded.Histogram.GetSampleSum(); got != 13 {
+		t.Errorf("sum = %v, want 13", got)
+	}
+	want := map[float64]uint64{1: 1, 10: 3}
+	for _, bucket := range folded.Histogram.Bucket {
+		if got := bucket.GetCumulativeCount(); got != want[bucket.GetUpperBound()] {
+			t.Errorf("bucket %v = %v, want %v", bucket.GetUpperBound(), got, want[bucket.GetUpperBound()])
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	dataAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemExporter,
+			"data_age_seconds",
+		),
+		"Seconds since the data served by a collector was last updated",
+		[]string{"collector"},
+		nil,
+	)
+	snapshotLastSaveDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemExporter,
+			"snapshot_last_save_timestamp_seconds",
+		),
+		"Timestamp of the last successful snapshot write",
+		nil,
+		nil,
+	)
+)
+
+// persistentCollector is implemented by collectors whose holders are
+// written to the snapshot file.
+type persistentCollector interface {
+	// holders keyed by a name that is stable across releases. The type of
+	// the data of a holder is not: a holder saved by another release may
+	// fail to decode, and is then skipped when the snapshot is loaded.
+	dataHolders() map[string]holder
+}
+
+// snapshot file layout
+type snapshot struct {
+	SavedAt    time.Time                             `json:"saved_at"`
+	Collectors map[string]map[string]json.RawMessage `json:"collectors"`
+}
+
+// LoadSnapshot restores the holders of every collector from the snapshot
+// file at path. A missing file is not an error, a holder that fails to
+// decode is logged and left empty, to be filled by the next collection.
+func (c *BitbucketCollector) LoadSnapshot(path string) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading snapshot %q: %v", path, err)
+	}
+
+	var s snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("error parsing snapshot %q: %v", path, err)
+	}
+
+	for name, collector := range c.collectors {
+		pc, ok := collector.(persistentCollector)
+		if !ok {
+			continue
+		}
+		saved, ok := s.Collectors[name]
+		if !ok {
+			continue
+		}
+		for key, h := range pc.dataHolders() {
+			raw, ok := saved[key]
+			if !ok {
+				continue
+			}
+			if err := h.UnmarshalJSON(raw); err != nil {
+				c.logger.Warn("skipping holder of snapshot", "path", path, "collector", name, "holder", key, "err", err)
+			}
+		}
+	}
+	c.logger.Info("snapshot loaded", "path", path, "saved_at", s.SavedAt)
+	return nil
+}
+
+// SaveSnapshot writes the holders of every collector to path.
+//
+// The file is replaced atomically, so a crash while saving keeps the
+// previous snapshot.
+func (c *BitbucketCollector) SaveSnapshot(path string) error {
+	s := snapshot{
+		SavedAt:    time.Now(),
+		Collectors: map[string]map[string]json.RawMessage{},
+	}
+	for name, collector := range c.collectors {
+		pc, ok := collector.(persistentCollector)
+		if !ok {
+			continue
+		}
+		holders := map[string]json.RawMessage{}
+		for key, h := range pc.dataHolders() {
+			raw, err := h.MarshalJSON()
+			if err != nil {
+				return fmt.Errorf("error encoding %s/%s: %v", name, key, err)
+			}
+			holders[key] = raw
+		}
+		s.Collectors[name] = holders
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("error encoding snapshot: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("error writing snapshot %q: %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing snapshot %q: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing snapshot %q: %v", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error writing snapshot %q: %v", path, err)
+	}
+
+	c.lastSnapshot.Lock()
+	c.lastSnapshot.data = s.SavedAt
+	c.lastSnapshot.Unlock()
+	return nil
+}
+
+// collectDataAge sends the age of the data held by every collector.
+func collectDataAge(
+	ch chan<- prometheus.Metric,
+	collectors map[string]Collector,
+	lastSnapshot *DataHolder[time.Time],
+) {
+	now := time.Now()
+	for name, collector := range collectors {
+		pc, ok := collector.(persistentCollector)
+		if !ok {
+			continue
+		}
+		var updatedAt time.Time
+		for _, h := range pc.dataHolders() {
+			if t := h.lastUpdate(); t.After(updatedAt) {
+				updatedAt = t
+			}
+		}
+		// nothing collected or restored yet
+		if updatedAt.IsZero() {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			dataAgeDesc,
+			prometheus.GaugeValue,
+			now.Sub(updatedAt).Seconds(),
+			name,
+		)
+	}
+
+	lastSnapshot.Lock()
+	defer lastSnapshot.Unlock()
+	if lastSnapshot.data.IsZero() {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(
+		snapshotLastSaveDesc,
+		prometheus.GaugeValue,
+		float64(lastSnapshot.data.Unix()),
+	)
+}
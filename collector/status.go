@@ -0,0 +1,112 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// CollectorStatus describes the runs of a collector.
+type CollectorStatus struct {
+	Name string
+	// whether the collector is running now
+	Running bool
+	// start time of the last run
+	LastRun time.Time
+	// duration of the last finished run
+	Duration time.Duration
+	// error of the last finished run, empty on success
+	Error string
+	// end time of the last successful run
+	LastSuccess time.Time
+	// repositories the collector holds data for, -1 when not applicable
+	Repositories int
+	// start time of the next run, zero when not scheduled
+	NextRun time.Time
+}
+
+// repositoryCounter is implemented by collectors holding data per repository.
+type repositoryCounter interface {
+	repositoryCount() int
+}
+
+// Status returns the status of every collector, sorted by name.
+func (c *BitbucketCollector) Status() []CollectorStatus {
+	c.status.Lock()
+	defer c.status.Unlock()
+
+	status := make([]CollectorStatus, 0, len(c.status.data))
+	for _, v := range c.status.data {
+		status = append(status, *v)
+	}
+	slices.SortFunc(status, func(a, b CollectorStatus) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return status
+}
+
+// Ready reports whether every collector finished at least one successful run.
+func (c *BitbucketCollector) Ready() bool {
+	c.status.Lock()
+	defer c.status.Unlock()
+
+	for _, v := range c.status.data {
+		if v.LastSuccess.IsZero() {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *BitbucketCollector) startRun(name string, begin time.Time) {
+	c.status.Lock()
+	defer c.status.Unlock()
+
+	status := c.status.data[name]
+	status.Running = true
+	status.LastRun = begin
+	status.NextRun = time.Time{}
+}
+
+func (c *BitbucketCollector) finishRun(name string, collector Collector, duration time.Duration, err error) {
+	repositories := -1
+	if rc, ok := collector.(repositoryCounter); ok {
+		repositories = rc.repositoryCount()
+	}
+
+	c.status.Lock()
+	defer c.status.Unlock()
+
+	status := c.status.data[name]
+	status.Running = false
+	status.Duration = duration
+	status.Repositories = repositories
+	status.Error = ""
+	if err != nil {
+		status.Error = err.Error()
+		return
+	}
+	status.LastSuccess = time.Now()
+}
+
+func (c *BitbucketCollector) setNextRun(next time.Time) {
+	c.status.Lock()
+	defer c.status.Unlock()
+
+	for _, v := range c.status.data {
+		v.NextRun = next
+	}
+}
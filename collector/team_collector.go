@@ -0,0 +1,207 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"slices"
+	"strings"
+
+	"github.com/nandanurseptama/bitbucket-exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// prefix of the team members naming a Bitbucket group
+const teamGroupPrefix = "group:"
+
+var teamMembersDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(
+		namespace,
+		subSystemTeam,
+		"members",
+	),
+	"Total member of the workspace mapped to this team",
+	[]string{"workspace", "team"},
+	nil,
+)
+
+// teamCollector maps users to the teams of the config, other collectors
+// use it to aggregate their series per team.
+//
+// A nil teamCollector maps no user.
+type teamCollector struct {
+	config     *config.TeamsConfig
+	workspaces []string
+	// members of the workspaces, counted per team
+	members *memberCollector
+	// members of the groups named by the teams, keyed by workspace slug then group slug
+	groups *DataHolder[map[string]map[string][]User]
+}
+
+func NewTeamCollector(
+	config *config.TeamsConfig,
+	workspaces []string,
+	members *memberCollector,
+) *teamCollector {
+	return &teamCollector{
+		config:     config,
+		workspaces: workspaces,
+		members:    members,
+		groups: &DataHolder[map[string]map[string][]User]{
+			data: map[string]map[string][]User{},
+		},
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *teamCollector) Collect(ch chan<- prometheus.Metric) {
+	c.members.members.Lock()
+	members := map[string][]User{}
+	for k, v := range c.members.members.data {
+		members[k] = v
+	}
+	c.members.members.Unlock()
+
+	for workspace, users := range members {
+		totals := map[string]uint64{}
+		for _, user := range users {
+			for _, team := range c.teamsOf(workspace, user, "") {
+				totals[team]++
+			}
+		}
+		for team := range c.config.Members {
+			ch <- prometheus.MustNewConstMetric(
+				teamMembersDesc,
+				prometheus.GaugeValue,
+				float64(totals[team]),
+				workspace, team,
+			)
+		}
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *teamCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- teamMembersDesc
+}
+
+func (c *teamCollector) dataHolders() map[string]holder {
+	return map[string]holder{"groups": c.groups}
+}
+
+// Exec fetches the members of the groups named by the teams. Groups are
+// only exposed by the 1.0 API, which lists every member of a group in one
+// response. A group failing to be fetched is logged and keeps its previous
+// members, so one group does not hold back the others.
+func (c *teamCollector) Exec(ctx context.Context, instance *instance) error {
+	var slugs []string
+	for _, members := range c.config.Members {
+		for _, member := range members {
+			slug, ok := strings.CutPrefix(member, teamGroupPrefix)
+			if ok && !slices.Contains(slugs, slug) {
+				slugs = append(slugs, slug)
+			}
+		}
+	}
+
+	for _, workspace := range c.workspaces {
+		c.groups.Lock()
+		previous := c.groups.data[workspace]
+		c.groups.Unlock()
+
+		groups := map[string][]User{}
+		for _, slug := range slugs {
+			var users []User
+			err := instance.GETLegacy(
+				ctx,
+				groupMembersEndpoint,
+				map[string]string{":workspace": workspace, ":group_slug": slug},
+				map[string]string{},
+				&users,
+			)
+			// a group may only exist in some of the workspaces
+			if errors.Is(err, errNotFound) {
+				continue
+			}
+			if err != nil {
+				instance.logger.Warn("error fetching group members", "workspace", workspace, "group", slug, "err", err)
+				if users, ok := previous[slug]; ok {
+					groups[slug] = users
+				}
+				continue
+			}
+			groups[slug] = users
+		}
+
+		c.groups.Lock()
+		c.groups.data[workspace] = groups
+		c.groups.touch()
+		c.groups.Unlock()
+	}
+
+	return nil
+}
+
+// teamsOf returns the sorted teams of user in workspace, matched by uuid,
+// nickname, email or group. email is empty when unknown.
+func (c *teamCollector) teamsOf(workspace string, user User, email string) []string {
+	if c == nil {
+		return nil
+	}
+
+	c.groups.Lock()
+	groups := c.groups.data[workspace]
+	c.groups.Unlock()
+
+	var teams []string
+	for team, members := range c.config.Members {
+		for _, member := range members {
+			if teamMemberMatch(member, user, email, groups) {
+				teams = append(teams, team)
+				break
+			}
+		}
+	}
+	slices.Sort(teams)
+	return teams
+}
+
+// dropUserSeries reports whether the series labelled by user are dropped.
+func (c *teamCollector) dropUserSeries() bool {
+	return c != nil && c.config.DropUserSeries
+}
+
+// teamMemberMatch reports whether a member of a team in the config is user.
+func teamMemberMatch(member string, user User, email string, groups map[string][]User) bool {
+	if slug, ok := strings.CutPrefix(member, teamGroupPrefix); ok {
+		return slices.ContainsFunc(groups[slug], func(v User) bool {
+			return v.Uuid == user.Uuid
+		})
+	}
+	if strings.Contains(member, "@") {
+		return email != "" && strings.EqualFold(member, email)
+	}
+	return member != "" && (member == user.Uuid || member == user.Nickname)
+}
+
+// authorEmail returns the email of a raw commit author, `name <email>`.
+func authorEmail(raw string) string {
+	address, err := mail.ParseAddress(raw)
+	if err != nil {
+		return ""
+	}
+	return address.Address
+}
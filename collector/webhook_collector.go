@@ -0,0 +1,303 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nandanurseptama/bitbucket-exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type hookData struct {
+	// only the host of the target url, the full url may hold a secret
+	Host   string   `json:"host"`
+	Active bool     `json:"active"`
+	Events []string `json:"events"`
+}
+
+type webhookData struct {
+	Workspace string `json:"workspace"`
+	// project and repository are empty for workspace webhooks
+	Project    string     `json:"project"`
+	Repository string     `json:"repository"`
+	Hooks      []hookData `json:"hooks"`
+}
+
+var (
+	webhookLabels = []string{"workspace", "project", "repository"}
+
+	webhookTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemWebhook,
+			"total",
+		),
+		"Total webhook of this repo, or of the workspace when repository is empty",
+		webhookLabels,
+		nil,
+	)
+	webhookActiveDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemWebhook,
+			"active",
+		),
+		"Total active webhook of this repo, or of the workspace when repository is empty",
+		webhookLabels,
+		nil,
+	)
+	webhookEventsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemWebhook,
+			"events",
+		),
+		"Total webhook subscribed to this event",
+		append(webhookLabels, "event"),
+		nil,
+	)
+	webhookHostDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemWebhook,
+			"host",
+		),
+		"Total webhook sending to this host",
+		append(webhookLabels, "host", "allowed"),
+		nil,
+	)
+	webhookNotAllowedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemWebhook,
+			"not_allowed",
+		),
+		"Total webhook sending to a host outside allowed_domains",
+		webhookLabels,
+		nil,
+	)
+)
+
+type webhookCollector struct {
+	config     *config.WebhookCollectorConfig
+	workspaces []string
+	feed       *repositoryFeed
+	// keyed by repository uuid
+	holders *DataHolder[map[string]webhookData]
+	// keyed by workspace slug
+	workspaceHolders *DataHolder[map[string]webhookData]
+}
+
+func NewWebhookCollector(
+	config *config.WebhookCollectorConfig,
+	workspaces []string,
+	feed *repositoryFeed,
+) *webhookCollector {
+	return &webhookCollector{
+		config:     config,
+		workspaces: workspaces,
+		feed:       feed,
+		holders: &DataHolder[map[string]webhookData]{
+			data: map[string]webhookData{},
+		},
+		workspaceHolders: &DataHolder[map[string]webhookData]{
+			data: map[string]webhookData{},
+		},
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *webhookCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, v := range holderValues(c.holders, c.workspaceHolders) {
+		labels := []string{v.Workspace, v.Project, v.Repository}
+
+		var active, notAllowed uint64
+		events := map[string]uint64{}
+		hosts := map[string]uint64{}
+		for _, hook := range v.Hooks {
+			if hook.Active {
+				active++
+			}
+			for _, event := range hook.Events {
+				events[event]++
+			}
+			hosts[hook.Host]++
+			if !c.allowedHost(hook.Host) {
+				notAllowed++
+			}
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			webhookTotalDesc,
+			prometheus.GaugeValue,
+			float64(len(v.Hooks)),
+			labels...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			webhookActiveDesc,
+			prometheus.GaugeValue,
+			float64(active),
+			labels...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			webhookNotAllowedDesc,
+			prometheus.GaugeValue,
+			float64(notAllowed),
+			labels...,
+		)
+		for event, total := range events {
+			ch <- prometheus.MustNewConstMetric(
+				webhookEventsDesc,
+				prometheus.GaugeValue,
+				float64(total),
+				append(labels, event)...,
+			)
+		}
+		for host, total := range hosts {
+			ch <- prometheus.MustNewConstMetric(
+				webhookHostDesc,
+				prometheus.GaugeValue,
+				float64(total),
+				append(labels, host, strconv.FormatBool(c.allowedHost(host)))...,
+			)
+		}
+	}
+}
+
+// allowedHost reports whether host is one of allowed_domains or a
+// subdomain of them.
+func (c *webhookCollector) allowedHost(host string) bool {
+	if len(c.config.AllowedDomains) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, domain := range c.config.AllowedDomains {
+		domain = strings.ToLower(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *webhookCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- webhookTotalDesc
+	ch <- webhookActiveDesc
+	ch <- webhookEventsDesc
+	ch <- webhookHostDesc
+	ch <- webhookNotAllowedDesc
+}
+
+func (c *webhookCollector) dataHolders() map[string]holder {
+	return map[string]holder{"webhooks": c.holders, "workspace_webhooks": c.workspaceHolders}
+}
+
+func (c *webhookCollector) repositoryCount() int {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+	return len(c.holders.data)
+}
+
+func (c *webhookCollector) Exec(ctx context.Context, instance *instance) error {
+	var wg sync.WaitGroup
+	var workspaceErrs []error
+
+	if c.config.CollectWorkspaceHooks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, workspace := range c.workspaces {
+				data := webhookData{Workspace: workspace}
+				hooks, err := c.getHooks(ctx, instance, workspaceHooksEndpoint, map[string]string{":workspace": workspace})
+				if skippable(err) {
+					c.feed.logger.Info("skipping workspace", "collector", keyWebhookCollector, "workspace", workspace, "err", err)
+					c.workspaceHolders.Lock()
+					delete(c.workspaceHolders.data, workspace)
+					c.workspaceHolders.touch()
+					c.workspaceHolders.Unlock()
+					continue
+				}
+				if err != nil {
+					workspaceErrs = append(workspaceErrs, fmt.Errorf("error collecting webhooks of %s: %w", workspace, err))
+					continue
+				}
+				data.Hooks = hooks
+				c.workspaceHolders.Lock()
+				c.workspaceHolders.data[workspace] = data
+				c.workspaceHolders.touch()
+				c.workspaceHolders.Unlock()
+			}
+		}()
+	}
+
+	err := collectRepositories(
+		c.feed,
+		keyWebhookCollector,
+		func(repo Repository) bool {
+			return includesRepository(c.config.IncludedRepository, repo)
+		},
+		c.holders,
+		"webhooks",
+		func(repo Repository) (webhookData, error) {
+			data := webhookData{
+				Workspace:  repo.Workspace.Slug,
+				Project:    repo.Project.Key,
+				Repository: repo.Slug,
+			}
+			pathParams := map[string]string{":workspace": repo.Workspace.Slug, ":repo_slug": repo.Slug}
+			hooks, err := c.getHooks(ctx, instance, repositoryHooksEndpoint, pathParams)
+			data.Hooks = hooks
+			return data, err
+		},
+	)
+
+	// wait until webhooks of every workspace collected
+	wg.Wait()
+	return errors.Join(append(workspaceErrs, err)...)
+}
+
+func (c *webhookCollector) getHooks(
+	ctx context.Context,
+	instance *instance,
+	endpoint string,
+	pathParams map[string]string,
+) ([]hookData, error) {
+	var hooks []hookData
+	err := getAllPages(
+		ctx,
+		instance,
+		endpoint,
+		pathParams,
+		map[string]string{"pagelen": "100"},
+		func(values []Webhook) error {
+			for _, v := range values {
+				var host string
+				if target, err := url.Parse(v.Url); err == nil {
+					host = target.Hostname()
+				}
+				hooks = append(hooks, hookData{Host: host, Active: v.Active, Events: v.Events})
+			}
+			return nil
+		},
+	)
+	return hooks, err
+}
@@ -0,0 +1,368 @@
+// Copyright 2022 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package collector
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/nandanurseptama/bitbucket-exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type planLimits struct {
+	// zero when unlimited
+	seats        uint64
+	buildMinutes uint64
+	// Git LFS storage in GB
+	lfsStorageGB float64
+}
+
+// limits of the Bitbucket Cloud plans, the API does not expose them
+var plans = map[string]planLimits{
+	"free":     {seats: 5, buildMinutes: 50, lfsStorageGB: 1},
+	"standard": {buildMinutes: 2500, lfsStorageGB: 5},
+	"premium":  {buildMinutes: 3500, lfsStorageGB: 10},
+}
+
+type buildMinutesData struct {
+	Workspace  string `json:"workspace"`
+	Project    string `json:"project"`
+	Repository string `json:"repository"`
+	// billing cycle the build time is counted in
+	CycleStart   time.Time `json:"cycle_start"`
+	BuildSeconds uint64    `json:"build_seconds"`
+}
+
+var (
+	workspaceLabels = []string{"workspace"}
+
+	workspacePlanDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemWorkspace,
+			"plan_info",
+		),
+		"Plan of the workspace",
+		append(workspaceLabels, "plan"),
+		nil,
+	)
+	workspaceSeatsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemWorkspace,
+			"seats",
+		),
+		"Total user seat used by the members of the workspace",
+		workspaceLabels,
+		nil,
+	)
+	workspaceSeatLimitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemWorkspace,
+			"seat_limit",
+		),
+		"User seats allowed by the plan of the workspace, not exported when unlimited",
+		workspaceLabels,
+		nil,
+	)
+	workspaceMinutesUsedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemWorkspace,
+			"build_minutes_used",
+		),
+		"Pipeline build minutes used by the workspace in the current billing cycle",
+		workspaceLabels,
+		nil,
+	)
+	workspaceMinutesAllowanceDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemWorkspace,
+			"build_minutes_allowance",
+		),
+		"Monthly pipeline build minutes included in the plan of the workspace",
+		workspaceLabels,
+		nil,
+	)
+	workspaceMinutesExhaustedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemWorkspace,
+			"build_minutes_exhausted_timestamp_seconds",
+		),
+		"Time the build minutes allowance runs out when used at the pace of the current billing cycle",
+		workspaceLabels,
+		nil,
+	)
+	workspaceCycleEndDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemWorkspace,
+			"billing_cycle_end_timestamp_seconds",
+		),
+		"End of the current billing cycle of the workspace",
+		workspaceLabels,
+		nil,
+	)
+	workspaceCycleDaysRemainingDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemWorkspace,
+			"billing_cycle_days_remaining",
+		),
+		"Days remaining in the current billing cycle of the workspace",
+		workspaceLabels,
+		nil,
+	)
+	workspaceRepositoryMinutesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(
+			namespace,
+			subSystemWorkspace,
+			"repository_build_minutes_used",
+		),
+		"Pipeline build minutes used by this repo in the current billing cycle",
+		[]string{"workspace", "project", "repository"},
+		nil,
+	)
+)
+
+type workspaceCollector struct {
+	config     *config.WorkspaceCollectorConfig
+	workspaces []string
+	feed       *repositoryFeed
+	// seats are the members it collected
+	members *memberCollector
+	// keyed by repository uuid
+	holders *DataHolder[map[string]buildMinutesData]
+}
+
+func NewWorkspaceCollector(
+	config *config.WorkspaceCollectorConfig,
+	workspaces []string,
+	feed *repositoryFeed,
+	members *memberCollector,
+) *workspaceCollector {
+	return &workspaceCollector{
+		config:     config,
+		workspaces: workspaces,
+		feed:       feed,
+		members:    members,
+		holders: &DataHolder[map[string]buildMinutesData]{
+			data: map[string]buildMinutesData{},
+		},
+	}
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *workspaceCollector) Collect(ch chan<- prometheus.Metric) {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+
+	now := time.Now()
+
+	// build time of the repos collected in the current cycle of their
+	// workspace
+	buildSeconds := map[string]uint64{}
+	for _, v := range c.holders.data {
+		workspacePlan := c.config.Plan(v.Workspace)
+		if workspacePlan == nil {
+			continue
+		}
+		if start, _ := billingCycle(now, workspacePlan.BillingDay); !v.CycleStart.Equal(start) {
+			continue
+		}
+		buildSeconds[v.Workspace] += v.BuildSeconds
+		ch <- prometheus.MustNewConstMetric(
+			workspaceRepositoryMinutesDesc,
+			prometheus.GaugeValue,
+			float64(v.BuildSeconds)/60,
+			v.Workspace, v.Project, v.Repository,
+		)
+	}
+
+	for _, workspace := range c.workspaces {
+		workspacePlan := c.config.Plan(workspace)
+		if workspacePlan == nil {
+			continue
+		}
+		plan := strings.ToLower(workspacePlan.Plan)
+		limits := plans[plan]
+		seatLimit := workspacePlan.SeatLimit
+		if seatLimit == 0 {
+			seatLimit = limits.seats
+		}
+		allowance := workspacePlan.BuildMinutes
+		if allowance == 0 {
+			allowance = limits.buildMinutes
+		}
+		start, end := billingCycle(now, workspacePlan.BillingDay)
+
+		ch <- prometheus.MustNewConstMetric(
+			workspacePlanDesc,
+			prometheus.GaugeValue,
+			1,
+			workspace, plan,
+		)
+		if seats, known := c.members.memberCount(workspace); known {
+			ch <- prometheus.MustNewConstMetric(
+				workspaceSeatsDesc,
+				prometheus.GaugeValue,
+				float64(seats),
+				workspace,
+			)
+		}
+		if seatLimit > 0 {
+			ch <- prometheus.MustNewConstMetric(
+				workspaceSeatLimitDesc,
+				prometheus.GaugeValue,
+				float64(seatLimit),
+				workspace,
+			)
+		}
+		if allowance > 0 {
+			ch <- prometheus.MustNewConstMetric(
+				workspaceMinutesAllowanceDesc,
+				prometheus.GaugeValue,
+				float64(allowance),
+				workspace,
+			)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			workspaceCycleEndDesc,
+			prometheus.GaugeValue,
+			float64(end.Unix()),
+			workspace,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			workspaceCycleDaysRemainingDesc,
+			prometheus.GaugeValue,
+			end.Sub(now).Hours()/24,
+			workspace,
+		)
+
+		// unknown until the repos are collected in the current cycle
+		seconds, ok := buildSeconds[workspace]
+		if !ok {
+			continue
+		}
+		used := float64(seconds) / 60
+		ch <- prometheus.MustNewConstMetric(
+			workspaceMinutesUsedDesc,
+			prometheus.GaugeValue,
+			used,
+			workspace,
+		)
+		if used > 0 && allowance > 0 {
+			elapsed := now.Sub(start).Seconds()
+			exhausted := float64(start.Unix()) + elapsed*float64(allowance)/used
+			ch <- prometheus.MustNewConstMetric(
+				workspaceMinutesExhaustedDesc,
+				prometheus.GaugeValue,
+				exhausted,
+				workspace,
+			)
+		}
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *workspaceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- workspacePlanDesc
+	ch <- workspaceSeatsDesc
+	ch <- workspaceSeatLimitDesc
+	ch <- workspaceMinutesUsedDesc
+	ch <- workspaceMinutesAllowanceDesc
+	ch <- workspaceMinutesExhaustedDesc
+	ch <- workspaceCycleEndDesc
+	ch <- workspaceCycleDaysRemainingDesc
+	ch <- workspaceRepositoryMinutesDesc
+}
+
+func (c *workspaceCollector) dataHolders() map[string]holder {
+	return map[string]holder{"build_minutes": c.holders}
+}
+
+func (c *workspaceCollector) repositoryCount() int {
+	c.holders.Lock()
+	defer c.holders.Unlock()
+	return len(c.holders.data)
+}
+
+func (c *workspaceCollector) Exec(ctx context.Context, instance *instance) error {
+	now := time.Now()
+
+	return collectRepositories(
+		c.feed,
+		keyWorkspaceCollector,
+		func(repo Repository) bool {
+			// every repository of a workspace with a plan is billed, whatever
+			// the other collectors include
+			return c.config.Plan(repo.Workspace.Slug) != nil
+		},
+		c.holders,
+		"build minutes",
+		func(repo Repository) (buildMinutesData, error) {
+			start, _ := billingCycle(now, c.config.Plan(repo.Workspace.Slug).BillingDay)
+			data := buildMinutesData{
+				Workspace:  repo.Workspace.Slug,
+				Project:    repo.Project.Key,
+				Repository: repo.Slug,
+				CycleStart: start,
+			}
+			seconds, err := getBuildSeconds(ctx, instance, repo, start)
+			data.BuildSeconds = seconds
+			return data, err
+		},
+	)
+}
+
+// getBuildSeconds returns the build time of the pipelines of repo created
+// since.
+func getBuildSeconds(ctx context.Context, instance *instance, repo Repository, since time.Time) (uint64, error) {
+	var seconds uint64
+	err := getAllPages(
+		ctx,
+		instance,
+		pipelinesEndpoint,
+		map[string]string{":workspace": repo.Workspace.Slug, ":repo_slug": repo.Slug},
+		map[string]string{"pagelen": "100", "sort": "-created_on"},
+		func(values []Pipeline) error {
+			for _, v := range values {
+				if v.CreatedOn.Before(since) {
+					return errLastPage
+				}
+				seconds += v.BuildSecondsUsed
+			}
+			return nil
+		},
+	)
+	return seconds, err
+}
+
+// billingCycle returns the billing cycle now is in, starting on day of the
+// month at midnight UTC.
+func billingCycle(now time.Time, day int) (start time.Time, end time.Time) {
+	// every month has the day
+	day = min(max(day, 1), 28)
+	now = now.UTC()
+	start = time.Date(now.Year(), now.Month(), day, 0, 0, 0, 0, time.UTC)
+	if start.After(now) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start, start.AddDate(0, 1, 0)
+}
@@ -18,6 +18,7 @@ import (
 	"log/slog"
 	"os"
 	"sync"
+	"time"
 
 	"go.yaml.in/yaml/v3"
 )
@@ -33,11 +34,305 @@ type CommitCollectorConfig struct {
 	CollectTotalCommitUser bool     `yaml:"collect_total_commit_user"`
 	IncludedRepository     []string `yaml:"included_repository"`
 }
+
+type HygieneCollectorConfig struct {
+	IncludedRepository []string `yaml:"included_repository"`
+	// repository without commit on its main branch for this many days is stale
+	StaleDays int `yaml:"stale_days"`
+}
+
+type BranchRestrictionsCollectorConfig struct {
+	IncludedRepository []string `yaml:"included_repository"`
+}
+
+type CommitStatusCollectorConfig struct {
+	IncludedRepository []string `yaml:"included_repository"`
+}
+
+type CodeInsightsCollectorConfig struct {
+	IncludedRepository []string `yaml:"included_repository"`
+}
+
+type IssueCollectorConfig struct {
+	IncludedRepository []string `yaml:"included_repository"`
+}
+
+type ProjectCollectorConfig struct {
+	// export key, name, visibility and dates of every project
+	CollectInfo bool `yaml:"collect_info"`
+	// sum repository, size, branch, tag and commit of repositories per project
+	CollectRollup bool `yaml:"collect_rollup"`
+}
+
+type WebhookCollectorConfig struct {
+	IncludedRepository []string `yaml:"included_repository"`
+	// audit the webhooks of included workspaces too, needs admin access
+	CollectWorkspaceHooks bool `yaml:"collect_workspace_hooks"`
+	// domains webhooks may send to, subdomains included, empty allows any
+	AllowedDomains []string `yaml:"allowed_domains"`
+}
+
+type KeyCollectorConfig struct {
+	// repositories whose deploy keys will be collected
+	IncludedRepository []string `yaml:"included_repository"`
+	// collect ssh keys of the authenticated user, Bitbucket does not
+	// return the keys of other users
+	CollectUserKeys bool `yaml:"collect_user_keys"`
+	// key older than this many days is due for rotation, zero disables
+	RotationDays int `yaml:"rotation_days"`
+}
+
+type PipelineVariableCollectorConfig struct {
+	// repositories whose repository and deployment variables will be audited
+	IncludedRepository []string `yaml:"included_repository"`
+	// audit workspace variables of included workspaces too
+	CollectWorkspaceVariables bool `yaml:"collect_workspace_variables"`
+	// unsecured variable whose name contains one of these is flagged,
+	// case insensitive, defaults to TOKEN, PASSWORD, SECRET and KEY
+	SecretPatterns []string `yaml:"secret_patterns"`
+}
+
+type RunnerCollectorConfig struct {
+	// repositories whose self-hosted runners will be collected
+	IncludedRepository []string `yaml:"included_repository"`
+	// collect self-hosted runners of included workspaces too
+	CollectWorkspaceRunners bool `yaml:"collect_workspace_runners"`
+}
+
+type PipelineCollectorConfig struct {
+	// repositories whose pipelines will be collected
+	IncludedRepository []string `yaml:"included_repository"`
+	// only pipelines created in the last lookback_days are looked at, default 7
+	LookbackDays int `yaml:"lookback_days"`
+	// most recent pipelines looked at per repository, default 100
+	MaxPipelines int `yaml:"max_pipelines"`
+	// collect test reports published by pipeline steps
+	CollectTestReports bool `yaml:"collect_test_reports"`
+	// most failing and flaky test cases exported per repository, default 10
+	TopTestCases int `yaml:"top_test_cases"`
+}
+
+type PullRequestCollectorConfig struct {
+	// repositories whose pull requests will be collected
+	IncludedRepository []string `yaml:"included_repository"`
+	// only pull requests updated in the last lookback_days are looked at, default 30
+	LookbackDays int `yaml:"lookback_days"`
+	// most recently updated pull requests looked at per repository and state, default 100
+	MaxPullRequests int `yaml:"max_pull_requests"`
+	// collect lines and files changed by merged pull requests
+	CollectDiffstat bool `yaml:"collect_diffstat"`
+}
+
+type CodeOwnersCollectorConfig struct {
+	IncludedRepository []string `yaml:"included_repository"`
+}
+
+type LFSCollectorConfig struct {
+	IncludedRepository []string `yaml:"included_repository"`
+	// Git LFS storage in GB keyed by workspace slug, a workspace left out
+	// takes the storage of its plan in the workspace collector
+	StorageQuotaGB map[string]float64 `yaml:"storage_quota_gb"`
+}
+
+type WorkspaceCollectorConfig struct {
+	// keyed by workspace slug, workspaces left out are not collected
+	Workspaces map[string]*WorkspacePlanConfig `yaml:"workspaces"`
+}
+
+type WorkspacePlanConfig struct {
+	// free, standard or premium
+	Plan string `yaml:"plan"`
+	// zero takes the limit of the plan
+	SeatLimit uint64 `yaml:"seat_limit"`
+	// monthly build minutes, zero takes the allowance of the plan
+	BuildMinutes uint64 `yaml:"build_minutes"`
+	// day of the month the billing cycle starts, 1 to 28
+	BillingDay int `yaml:"billing_day"`
+}
+
+type ForkCollectorConfig struct {
+	IncludedRepository []string `yaml:"included_repository"`
+}
+
+type PopularityCollectorConfig struct {
+	IncludedRepository []string `yaml:"included_repository"`
+	// weights of the popularity score, nil takes the default, zero leaves
+	// the term out
+	CommitterWeight *float64 `yaml:"committer_weight"`
+	WatcherWeight   *float64 `yaml:"watcher_weight"`
+	ForkWeight      *float64 `yaml:"fork_weight"`
+}
+
+type TeamsConfig struct {
+	// keyed by team name, members are user uuids, nicknames, emails or
+	// `group:<slug>` for the members of a Bitbucket group
+	Members map[string][]string `yaml:"members"`
+	// drop the series labelled by user, reviewer or CODEOWNERS owner, keeping
+	// the team aggregates and totals
+	DropUserSeries bool `yaml:"drop_user_series"`
+}
+
+type SeriesLimitConfig struct {
+	// series of a metric above which it is cut
+	MaxSeries int `yaml:"max_series"`
+	// series kept by highest value when a metric is cut, the rest is folded
+	// into `other` for additive metrics, default max_series - 1. Other
+	// metrics keep max_series series.
+	TopN int `yaml:"top_n"`
+}
+
+// Enabled reports whether the refs collector has anything to collect.
+func (c *RefsCollectorConfig) Enabled() bool {
+	if c == nil || len(c.IncludedRepository) < 1 {
+		return false
+	}
+	return c.CollectTotalBranch || c.CollectTotalTag
+}
+
+// Enabled reports whether the commit collector has anything to collect.
+func (c *CommitCollectorConfig) Enabled() bool {
+	if c == nil || len(c.IncludedRepository) < 1 {
+		return false
+	}
+	return c.CollectTotalCommitRepo || c.CollectTotalCommitUser
+}
+
+// Enabled reports whether the hygiene collector has anything to collect.
+func (c *HygieneCollectorConfig) Enabled() bool {
+	return c != nil && len(c.IncludedRepository) > 0
+}
+
+// Enabled reports whether the branch restrictions collector has anything to collect.
+func (c *BranchRestrictionsCollectorConfig) Enabled() bool {
+	return c != nil && len(c.IncludedRepository) > 0
+}
+
+// Enabled reports whether the commit status collector has anything to collect.
+func (c *CommitStatusCollectorConfig) Enabled() bool {
+	return c != nil && len(c.IncludedRepository) > 0
+}
+
+// Enabled reports whether the code insights collector has anything to collect.
+func (c *CodeInsightsCollectorConfig) Enabled() bool {
+	return c != nil && len(c.IncludedRepository) > 0
+}
+
+// Enabled reports whether the issue collector has anything to collect.
+func (c *IssueCollectorConfig) Enabled() bool {
+	return c != nil && len(c.IncludedRepository) > 0
+}
+
+// Enabled reports whether the project collector has anything to collect.
+func (c *ProjectCollectorConfig) Enabled() bool {
+	return c != nil && (c.CollectInfo || c.CollectRollup)
+}
+
+// Enabled reports whether the webhook collector has anything to audit.
+func (c *WebhookCollectorConfig) Enabled() bool {
+	return c != nil && (len(c.IncludedRepository) > 0 || c.CollectWorkspaceHooks)
+}
+
+// Enabled reports whether the key collector has anything to collect.
+func (c *KeyCollectorConfig) Enabled() bool {
+	return c != nil && (len(c.IncludedRepository) > 0 || c.CollectUserKeys)
+}
+
+// Enabled reports whether the pipeline variable collector has anything to audit.
+func (c *PipelineVariableCollectorConfig) Enabled() bool {
+	return c != nil && (len(c.IncludedRepository) > 0 || c.CollectWorkspaceVariables)
+}
+
+// Enabled reports whether the runner collector has anything to collect.
+func (c *RunnerCollectorConfig) Enabled() bool {
+	return c != nil && (len(c.IncludedRepository) > 0 || c.CollectWorkspaceRunners)
+}
+
+// Enabled reports whether the pipeline collector has a repository to collect.
+func (c *PipelineCollectorConfig) Enabled() bool {
+	return c != nil && len(c.IncludedRepository) > 0
+}
+
+// Enabled reports whether the pull request collector has a repository to collect.
+func (c *PullRequestCollectorConfig) Enabled() bool {
+	return c != nil && len(c.IncludedRepository) > 0
+}
+
+// Enabled reports whether the code owners collector has a repository to collect.
+func (c *CodeOwnersCollectorConfig) Enabled() bool {
+	return c != nil && len(c.IncludedRepository) > 0
+}
+
+// Enabled reports whether the LFS collector has a repository to collect.
+func (c *LFSCollectorConfig) Enabled() bool {
+	return c != nil && len(c.IncludedRepository) > 0
+}
+
+// Enabled reports whether the plan of a workspace is known.
+func (c *WorkspaceCollectorConfig) Enabled() bool {
+	return c != nil && len(c.Workspaces) > 0
+}
+
+// Plan returns the plan of workspace, nil when it is not known.
+func (c *WorkspaceCollectorConfig) Plan(workspace string) *WorkspacePlanConfig {
+	if c == nil {
+		return nil
+	}
+	plan := c.Workspaces[workspace]
+	if plan == nil || plan.Plan == "" {
+		return nil
+	}
+	return plan
+}
+
+// Enabled reports whether the fork collector has a repository to collect.
+func (c *ForkCollectorConfig) Enabled() bool {
+	return c != nil && len(c.IncludedRepository) > 0
+}
+
+// Enabled reports whether the popularity collector has a repository to collect.
+func (c *PopularityCollectorConfig) Enabled() bool {
+	return c != nil && len(c.IncludedRepository) > 0
+}
+
+// Enabled reports whether a team is defined.
+func (c *TeamsConfig) Enabled() bool {
+	return c != nil && len(c.Members) > 0
+}
+
+// Enabled reports whether the series are limited.
+func (c *SeriesLimitConfig) Enabled() bool {
+	return c != nil && c.MaxSeries > 0
+}
+
 type Config struct {
-	Auth              *AuthConfig            `yaml:"auth"`
-	IncludedWorkspace []string               `yaml:"included_workspaces"`
-	CommitCollector   *CommitCollectorConfig `yaml:"commit_collector"`
-	RefsCollector     *RefsCollectorConfig   `yaml:"refs_collector"`
+	Auth                        *AuthConfig                        `yaml:"auth"`
+	IncludedWorkspace           []string                           `yaml:"included_workspaces"`
+	CommitCollector             *CommitCollectorConfig             `yaml:"commit_collector"`
+	RefsCollector               *RefsCollectorConfig               `yaml:"refs_collector"`
+	HygieneCollector            *HygieneCollectorConfig            `yaml:"hygiene_collector"`
+	BranchRestrictionsCollector *BranchRestrictionsCollectorConfig `yaml:"branch_restrictions_collector"`
+	CommitStatusCollector       *CommitStatusCollectorConfig       `yaml:"commit_status_collector"`
+	CodeInsightsCollector       *CodeInsightsCollectorConfig       `yaml:"code_insights_collector"`
+	IssueCollector              *IssueCollectorConfig              `yaml:"issue_collector"`
+	ProjectCollector            *ProjectCollectorConfig            `yaml:"project_collector"`
+	WebhookCollector            *WebhookCollectorConfig            `yaml:"webhook_collector"`
+	KeyCollector                *KeyCollectorConfig                `yaml:"key_collector"`
+	PipelineVariableCollector   *PipelineVariableCollectorConfig   `yaml:"pipeline_variable_collector"`
+	RunnerCollector             *RunnerCollectorConfig             `yaml:"runner_collector"`
+	PipelineCollector           *PipelineCollectorConfig           `yaml:"pipeline_collector"`
+	PullRequestCollector        *PullRequestCollectorConfig        `yaml:"pull_request_collector"`
+	CodeOwnersCollector         *CodeOwnersCollectorConfig         `yaml:"code_owners_collector"`
+	LFSCollector                *LFSCollectorConfig                `yaml:"lfs_collector"`
+	WorkspaceCollector          *WorkspaceCollectorConfig          `yaml:"workspace_collector"`
+	ForkCollector               *ForkCollectorConfig               `yaml:"fork_collector"`
+	PopularityCollector         *PopularityCollectorConfig         `yaml:"popularity_collector"`
+	// users mapped to teams, aggregated by every collector labelling users
+	Teams *TeamsConfig `yaml:"teams"`
+	// keyed by collector name
+	SeriesLimits map[string]*SeriesLimitConfig `yaml:"series_limits"`
+	// interval between the end of a collection and the start of the next one.
+	// zero collects once at startup.
+	CollectInterval time.Duration `yaml:"collect_interval"`
 }
 
 type Handler struct {
@@ -22,6 +22,13 @@ func BoolToString(value bool) string {
 	return "false"
 }
 
+func BoolToFloat(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
 // replace all string with replacer
 //
 //	// example